@@ -0,0 +1,138 @@
+package ipfilter
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Actions taken on blocked requests.
+const (
+	actionBlock    = "block"
+	actionRedirect = "redirect"
+	actionDrop     = "drop"
+	actionTarpit   = "tarpit"
+)
+
+// defaultTarpitMax is the default number of connections tarpitted at once.
+const defaultTarpitMax = 100
+
+// Tarpit limits the number of blocked requests being held at once.
+type Tarpit struct {
+	Max int
+	sem chan struct{}
+}
+
+// newTarpit returns a Tarpit holding at most max requests at once.
+func newTarpit(max int) *Tarpit {
+	return &Tarpit{Max: max, sem: make(chan struct{}, max)}
+}
+
+// act takes the action of the block which decided d on the blocked request.
+func (ipf IPFilter) act(w http.ResponseWriter, r *http.Request, d Decision, info clientInfo) (int, error) {
+	switch d.Path.Action {
+	case actionRedirect:
+		return redirect(w, r, d, info)
+	case actionDrop:
+		return drop(w, r, d, info)
+	case actionTarpit:
+		return ipf.tarpit(w, r, d, info)
+	}
+	return block(w, r, d, info)
+}
+
+// redirect sends the blocked client to the redirect target of the block.
+func redirect(w http.ResponseWriter, r *http.Request, d Decision, info clientInfo) (int, error) {
+	http.Redirect(w, r, redirectTarget(r, d, info), d.Path.RedirectCode)
+	return d.Path.RedirectCode, nil
+}
+
+// redirectTarget returns the redirect target of the block which decided d,
+// with its placeholders expanded. The values are escaped for where they
+// go: the path, or the query string and fragment.
+func redirectTarget(r *http.Request, d Decision, info clientInfo) string {
+	target, query := d.Path.RedirectURL, ""
+	if i := strings.IndexAny(target, "?#"); i >= 0 {
+		target, query = target[:i], target[i:]
+	}
+
+	inPath := strings.NewReplacer(
+		"{country}", url.PathEscape(info.Country),
+		"{client_ip}", url.PathEscape(info.field("client_ip")),
+		"{host}", url.PathEscape(r.Host),
+		"{path}", r.URL.EscapedPath(),
+		"{uri}", r.URL.RequestURI(),
+	)
+	inQuery := strings.NewReplacer(
+		"{country}", url.QueryEscape(info.Country),
+		"{client_ip}", url.QueryEscape(info.field("client_ip")),
+		"{host}", url.QueryEscape(r.Host),
+		"{path}", url.QueryEscape(r.URL.Path),
+		"{uri}", url.QueryEscape(r.URL.RequestURI()),
+	)
+	return inPath.Replace(target) + inQuery.Replace(query)
+}
+
+// redirectsToItself reports whether the block which decided d redirects the
+// request to the page it asks for, which would loop forever.
+func redirectsToItself(r *http.Request, d Decision, info clientInfo) bool {
+	if d.Path.Action != actionRedirect {
+		return false
+	}
+	target, err := url.Parse(redirectTarget(r, d, info))
+	if err != nil {
+		return false
+	}
+	target = r.URL.ResolveReference(target)
+	if target.Host != "" && !strings.EqualFold(target.Host, r.Host) {
+		return false
+	}
+	return target.Path == r.URL.Path
+}
+
+// drop closes the client's connection without sending a response. If the
+// connection can't be taken over, as with HTTP/2, the request is blocked
+// as usual.
+func drop(w http.ResponseWriter, r *http.Request, d Decision, info clientInfo) (int, error) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return block(w, r, d, info)
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		return block(w, r, d, info)
+	}
+	conn.Close()
+	// The connection is gone, nothing is to be written.
+	return 0, nil
+}
+
+// tarpit holds the blocked request for the delay of the block before
+// answering it, wasting the time of the client. Once the maximum number of
+// requests are held, the connections are dropped instead.
+func (ipf IPFilter) tarpit(w http.ResponseWriter, r *http.Request, d Decision, info clientInfo) (int, error) {
+	t := ipf.Config.Tarpit
+	if t == nil {
+		return block(w, r, d, info)
+	}
+
+	select {
+	case t.sem <- struct{}{}:
+		defer func() { <-t.sem }()
+	default:
+		log.Printf("ipfilter: Tarpit full, dropping %s", info.field("client_ip"))
+		return drop(w, r, d, info)
+	}
+
+	timer := time.NewTimer(d.Path.TarpitDelay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+		// The client gave up.
+		return 0, nil
+	}
+	return block(w, r, d, info)
+}
@@ -0,0 +1,174 @@
+package ipfilter
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+func TestRedirectAction(t *testing.T) {
+	TestCases := []struct {
+		inputIpfilterConfig string
+		reqIP               string
+		reqPath             string
+		expectedStatus      int
+		expectedLocation    string
+	}{
+		{fmt.Sprintf(`ipfilter / {
+			rule block
+			database %s
+			country CA
+			action redirect https://{country}.example.com{uri}
+		}`, DataBase), "24.53.192.20:_", "/shop?item=1", http.StatusFound, "https://CA.example.com/shop?item=1"},
+		{`ipfilter /shop {
+			rule allow
+			ip 10.0.0.0/8
+			action redirect /unavailable 307
+		}`, "192.168.0.1:_", "/shop", http.StatusTemporaryRedirect, "/unavailable"},
+		{`ipfilter /shop {
+			rule allow
+			ip 10.0.0.0/8
+			action redirect /unavailable 307
+		}`, "10.0.0.1:_", "/shop", http.StatusOK, ""},
+		// The placeholders are escaped for where they are.
+		{`ipfilter / {
+			rule block
+			ip 192.168.0.1
+			action redirect https://example.com/blocked{path}?from={uri}&ip={client_ip}
+		}`, "192.168.0.1:_", "/a%3Fb?c=1&d=2", http.StatusFound, "https://example.com/blocked/a%3Fb?from=%2Fa%253Fb%3Fc%3D1%26d%3D2&ip=192.168.0.1"},
+		// The target itself isn't redirected again.
+		{`ipfilter / {
+			rule block
+			ip 192.168.0.1
+			action redirect /blocked?from={uri}
+		}`, "192.168.0.1:_", "/blocked?from=%2Fshop", http.StatusOK, ""},
+		{`ipfilter / {
+			rule block
+			ip 192.168.0.1
+			action redirect /blocked?from={uri}
+		}`, "192.168.0.1:_", "/shop", http.StatusFound, "/blocked?from=%2Fshop"},
+	}
+
+	for i, tc := range TestCases {
+		c := caddy.NewTestController("http", tc.inputIpfilterConfig)
+		config, err := ipfilterParse(c)
+		if err != nil {
+			t.Fatalf("Test %d: could not parse config: %v", i, err)
+		}
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		req, err := http.NewRequest("GET", tc.reqPath, nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = tc.reqIP
+
+		rec := httptest.NewRecorder()
+		status, _ := ipf.ServeHTTP(rec, req)
+		if status != tc.expectedStatus {
+			t.Errorf("Test %d: expected status %d, got %d", i, tc.expectedStatus, status)
+		}
+		if location := rec.Header().Get("Location"); location != tc.expectedLocation {
+			t.Errorf("Test %d: expected Location %q, got %q", i, tc.expectedLocation, location)
+		}
+	}
+
+	for i, input := range []string{
+		`ipfilter / {
+			rule block
+			ip 10.0.0.1
+			action redirect
+		}`,
+		`ipfilter / {
+			rule block
+			ip 10.0.0.1
+			action redirect /away 200
+		}`,
+		`ipfilter / {
+			rule block
+			ip 10.0.0.1
+			action explode
+		}`,
+	} {
+		c := caddy.NewTestController("http", input)
+		if _, err := ipfilterParse(c); err == nil {
+			t.Errorf("Invalid action %d didn't error, but it should have", i)
+		}
+	}
+}
+
+func TestDropAndTarpitActions(t *testing.T) {
+	c := caddy.NewTestController("http", `ipfilter /drop {
+		rule block
+		ip 127.0.0.1
+		action drop
+	}
+	ipfilter /tarpit {
+		rule block
+		ip 127.0.0.1
+		action tarpit 200ms
+		tarpit_max 1
+	}`)
+	config, err := ipfilterParse(c)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+	ipf := IPFilter{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := ipf.ServeHTTP(w, r)
+		if status != 0 {
+			w.WriteHeader(status)
+		}
+	}))
+	defer srv.Close()
+
+	// The connection is closed without a response.
+	if resp, err := http.Get(srv.URL + "/drop"); err == nil {
+		resp.Body.Close()
+		t.Errorf("Expected the connection to be dropped, got status %d", resp.StatusCode)
+	}
+
+	// The response is delayed.
+	start := time.Now()
+	resp, err := http.Get(srv.URL + "/tarpit")
+	if err != nil {
+		t.Fatalf("Expected a response from the tarpit, got %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status %d, got %d", http.StatusForbidden, resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Expected the response to be delayed, got it after %s", elapsed)
+	}
+
+	// Over tarpit_max the connections are dropped.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, err := http.Get(srv.URL + "/tarpit"); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if resp, err := http.Get(srv.URL + "/tarpit"); err == nil {
+		resp.Body.Close()
+		t.Errorf("Expected the connection to be dropped once the tarpit is full, got status %d", resp.StatusCode)
+	}
+	<-done
+}
@@ -0,0 +1,215 @@
+package ipfilter
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Admin holds the configuration of the admin endpoint used to manage a
+// BanList at runtime.
+type Admin struct {
+	Path       string       // URL path prefix the endpoint is served at.
+	Token      string       // Bearer token required, if not empty.
+	Allow      []*net.IPNet // Remote addresses allowed, if not empty.
+	Bans       *BanList     // The list managed through the endpoint.
+	PersistDir string       // Prefix dir single address bans are written to.
+}
+
+// banJSON is how a Ban is represented by the admin endpoint.
+type banJSON struct {
+	CIDR    string     `json:"cidr"`
+	Reason  string     `json:"reason,omitempty"`
+	TTL     string     `json:"ttl,omitempty"`
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+func newBanJSON(b Ban) banJSON {
+	bj := banJSON{CIDR: b.Net.String(), Reason: b.Reason, Created: b.Created}
+	if !b.Expires.IsZero() {
+		expires := b.Expires
+		bj.Expires = &expires
+	}
+	return bj
+}
+
+// authorized checks the request against the admin_allow and admin_token
+// restrictions. The remote address is used as is, X-Forwarded-For is
+// never trusted here.
+func (a *Admin) authorized(r *http.Request) bool {
+	if len(a.Allow) != 0 {
+		clientIP, err := getClientIP(r, true)
+		if err != nil {
+			return false
+		}
+		allowed := false
+		for _, rng := range a.Allow {
+			if rng.Contains(clientIP) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+
+	if a.Token != "" {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return false
+		}
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) != 1 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// serveAdmin handles the requests to the admin endpoint:
+//
+//	GET    <path>/bans          list the bans
+//	POST   <path>/bans          add a ban: {"cidr": "", "ttl": "", "reason": ""}
+//	DELETE <path>/bans/<cidr>   lift a ban
+//	GET    <path>/check?ip=<ip> tell whether ip is allowed
+//	POST   <path>/tokens        mint a bypass token
+func (ipf IPFilter) serveAdmin(w http.ResponseWriter, r *http.Request) (int, error) {
+	admin := ipf.Config.Admin
+	if !admin.authorized(r) {
+		return http.StatusUnauthorized, nil
+	}
+
+	route := strings.Trim(strings.TrimPrefix(r.URL.Path, admin.Path), "/")
+	switch {
+	case route == "bans" && r.Method == http.MethodGet:
+		bans := admin.Bans.List()
+		list := make([]banJSON, len(bans))
+		for i, b := range bans {
+			list[i] = newBanJSON(b)
+		}
+		return writeJSON(w, http.StatusOK, list)
+
+	case route == "bans" && r.Method == http.MethodPost:
+		var req banJSON
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return http.StatusBadRequest, nil
+		}
+		ipnet, err := parseBanNet(req.CIDR)
+		if err != nil {
+			return http.StatusBadRequest, nil
+		}
+		b := Ban{Net: ipnet, Reason: req.Reason, Created: time.Now()}
+		if req.TTL != "" {
+			ttl, err := time.ParseDuration(req.TTL)
+			if err != nil || ttl <= 0 {
+				return http.StatusBadRequest, nil
+			}
+			b.Expires = b.Created.Add(ttl)
+		}
+		admin.Bans.Add(b)
+		if admin.PersistDir != "" && b.Expires.IsZero() {
+			if err := writeBanFile(admin.PersistDir, b); err != nil {
+				log.Println("ipfilter: Can't persist ban:", err)
+			}
+		}
+		return writeJSON(w, http.StatusCreated, newBanJSON(b))
+
+	case strings.HasPrefix(route, "bans/") && r.Method == http.MethodDelete:
+		cidr := strings.TrimPrefix(route, "bans/")
+		ipnet, err := parseBanNet(cidr)
+		if err != nil {
+			return http.StatusBadRequest, nil
+		}
+		if !admin.Bans.Remove(cidr) {
+			return http.StatusNotFound, nil
+		}
+		if admin.PersistDir != "" {
+			if err := removeBanFile(admin.PersistDir, ipnet); err != nil {
+				log.Println("ipfilter: Can't remove persisted ban:", err)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return http.StatusNoContent, nil
+
+	case route == "check" && r.Method == http.MethodGet:
+		ip := net.ParseIP(r.URL.Query().Get("ip"))
+		if ip == nil {
+			return http.StatusBadRequest, nil
+		}
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			path = "/"
+		}
+		// Evaluate a request from ip as if it came directly from it.
+		check, err := http.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			return http.StatusBadRequest, nil
+		}
+		check.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+		d, err := ipf.decide(ipf.newRequestState(check))
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		result := struct {
+			IP    string   `json:"ip"`
+			Path  string   `json:"path"`
+			Allow bool     `json:"allow"`
+			Ban   *banJSON `json:"ban,omitempty"`
+		}{IP: ip.String(), Path: path, Allow: d.Allow}
+		if b, ok := admin.Bans.Match(ip); ok {
+			bj := newBanJSON(b)
+			result.Ban = &bj
+		}
+		return writeJSON(w, http.StatusOK, result)
+
+	case route == "tokens" && r.Method == http.MethodPost:
+		bypass := ipf.Config.Bypass
+		if bypass == nil {
+			return http.StatusNotFound, nil
+		}
+		var req struct {
+			Scope string `json:"scope"`
+			TTL   string `json:"ttl"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return http.StatusBadRequest, nil
+		}
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			return http.StatusBadRequest, nil
+		}
+		expires := time.Now().Add(ttl).Truncate(time.Second)
+		result := struct {
+			Token   string    `json:"token"`
+			Scope   string    `json:"scope,omitempty"`
+			Expires time.Time `json:"expires"`
+		}{MintBypassToken(bypass.Secret, req.Scope, expires), req.Scope, expires}
+		return writeJSON(w, http.StatusCreated, result)
+	}
+
+	return http.StatusNotFound, nil
+}
+
+// matchesEndpoint reports whether path is the endpoint served at base or
+// one of its sub paths, e.g. "/_ipfilter/bans" but not "/_ipfilterfoo".
+func matchesEndpoint(path, base string) bool {
+	base = strings.TrimSuffix(base, "/")
+	return path == base || strings.HasPrefix(path, base+"/")
+}
+
+// writeJSON writes v as the JSON response body.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) (int, error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return 0, err
+	}
+	return status, nil
+}
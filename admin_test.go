@@ -0,0 +1,132 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+func TestAdmin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := caddy.NewTestController("http", `ipfilter / {
+		rule block
+		bans admintest
+		admin /_ipfilter admintest
+		admin_token s3cret
+		admin_allow 127.0.0.1
+		admin_persist `+dir+`
+	}`)
+	config, err := ipfilterParse(c)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+	ipf := IPFilter{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+
+	do := func(method, path, remote, token, body string) (int, string) {
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = remote
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		status, err := ipf.ServeHTTP(rec, req)
+		if err != nil {
+			t.Fatalf("%s %s: unexpected error: %v", method, path, err)
+		}
+		return status, rec.Body.String()
+	}
+
+	TestCases := []struct {
+		method, path, remote, token, body string
+		expectedStatus                    int
+	}{
+		// Authentication.
+		{"GET", "/_ipfilter/bans", "127.0.0.1:_", "", "", http.StatusUnauthorized},
+		{"GET", "/_ipfilter/bans", "127.0.0.1:_", "wrong", "", http.StatusUnauthorized},
+		{"GET", "/_ipfilter/bans", "10.0.0.1:_", "s3cret", "", http.StatusUnauthorized},
+		{"GET", "/_ipfilter/bans", "127.0.0.1:_", "s3cret", "", http.StatusOK},
+
+		// Bans take effect right away.
+		{"GET", "/", "10.1.2.3:_", "", "", http.StatusOK},
+		{"POST", "/_ipfilter/bans", "127.0.0.1:_", "s3cret", `{"cidr": "10.1.2.3", "reason": "spam"}`, http.StatusCreated},
+		{"POST", "/_ipfilter/bans", "127.0.0.1:_", "s3cret", `{"cidr": "2001:db8::/32", "ttl": "1h"}`, http.StatusCreated},
+		{"POST", "/_ipfilter/bans", "127.0.0.1:_", "s3cret", `{"cidr": "nope"}`, http.StatusBadRequest},
+		{"GET", "/", "10.1.2.3:_", "", "", http.StatusForbidden},
+		{"GET", "/", "[2001:db8::5]:_", "", "", http.StatusForbidden},
+		{"GET", "/_ipfilter/check?ip=10.1.2.3", "127.0.0.1:_", "s3cret", "", http.StatusOK},
+
+		// Lifting them.
+		{"DELETE", "/_ipfilter/bans/10.1.2.3", "127.0.0.1:_", "s3cret", "", http.StatusNoContent},
+		{"DELETE", "/_ipfilter/bans/2001:db8::/32", "127.0.0.1:_", "s3cret", "", http.StatusNoContent},
+		{"DELETE", "/_ipfilter/bans/10.1.2.3", "127.0.0.1:_", "s3cret", "", http.StatusNotFound},
+		{"GET", "/", "10.1.2.3:_", "", "", http.StatusOK},
+
+		// Only the paths under the endpoint are served by it.
+		{"GET", "/_ipfilterfoo", "10.0.0.1:_", "", "", http.StatusOK},
+	}
+
+	for i, tc := range TestCases {
+		status, body := do(tc.method, tc.path, tc.remote, tc.token, tc.body)
+		if status != tc.expectedStatus {
+			t.Fatalf("Test %d: %s %s expected StatusCode: '%d', Got: '%d' (%s)",
+				i, tc.method, tc.path, tc.expectedStatus, status, body)
+		}
+		if tc.path == "/_ipfilter/check?ip=10.1.2.3" {
+			var result struct {
+				Allow bool `json:"allow"`
+				Ban   *struct {
+					Reason string `json:"reason"`
+				} `json:"ban"`
+			}
+			if err := json.Unmarshal([]byte(body), &result); err != nil {
+				t.Fatalf("Test %d: invalid JSON %q: %v", i, body, err)
+			}
+			if result.Allow || result.Ban == nil || result.Ban.Reason != "spam" {
+				t.Errorf("Test %d: unexpected check result: %s", i, body)
+			}
+		}
+		if i == 5 {
+			// The single address ban was persisted.
+			reason, err := ioutil.ReadFile(filepath.Join(dir, "10", "1", "10.1.2.3"))
+			if err != nil || string(reason) != "spam\n" {
+				t.Errorf("Test %d: expected ban file with reason, got %q, %v", i, reason, err)
+			}
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "10", "1", "10.1.2.3")); !os.IsNotExist(err) {
+		t.Errorf("Expected persisted ban to be removed, got %v", err)
+	}
+}
+
+func TestAdminRequiresRestriction(t *testing.T) {
+	c := caddy.NewTestController("http", `ipfilter / {
+		rule block
+		bans
+		admin /_ipfilter
+	}`)
+	if _, err := ipfilterParse(c); err == nil {
+		t.Errorf("Expected an open admin endpoint to be an error")
+	}
+}
@@ -0,0 +1,193 @@
+package ipfilter
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+const (
+	// DefaultAutobanList is the ban list autoban adds offenders to.
+	DefaultAutobanList = "autoban"
+	// defaultAutobanTTL is how long an offender is banned for.
+	defaultAutobanTTL = time.Hour
+	// defaultAutobanIPv6Prefix is the size of the IPv6 networks tracked
+	// as a single client, a /64 usually being one host or one site.
+	defaultAutobanIPv6Prefix = 64
+)
+
+// AutobanRule bans the clients making more than Count matching requests
+// within Window.
+type AutobanRule struct {
+	Kind   string   // "requests", "status" or "path".
+	Status int      // Response status counted by a "status" rule.
+	Paths  []string // Path prefixes counted by a "path" rule.
+	Count  int
+	Window time.Duration
+
+	mu        sync.Mutex
+	hits      map[string]*autobanWindow
+	nextPrune time.Time
+}
+
+// autobanWindow counts the hits of a client in the current window.
+type autobanWindow struct {
+	start time.Time
+	count int
+}
+
+// Autoban tracks offending clients and bans them for a while.
+type Autoban struct {
+	Rules      []*AutobanRule
+	TTL        time.Duration
+	IPv6Prefix int
+	Bans       *BanList
+}
+
+// newAutoban returns an Autoban with the defaults set.
+func newAutoban() *Autoban {
+	return &Autoban{
+		TTL:        defaultAutobanTTL,
+		IPv6Prefix: defaultAutobanIPv6Prefix,
+		Bans:       GetBanList(DefaultAutobanList),
+	}
+}
+
+// parseAutobanRule parses the arguments of an autoban directive:
+//
+//	requests <count> <window>
+//	status   <code> <count> <window>
+//	path     <count> <window> <path...>
+func parseAutobanRule(args []string) (*AutobanRule, error) {
+	if len(args) < 3 {
+		return nil, fmt.Errorf("Invalid autoban rule: %v", args)
+	}
+	rule := &AutobanRule{Kind: args[0], hits: make(map[string]*autobanWindow)}
+	rest := args[1:]
+
+	switch rule.Kind {
+	case "requests":
+		if len(rest) != 2 {
+			return nil, fmt.Errorf("Invalid autoban rule: %v", args)
+		}
+	case "status":
+		if len(rest) != 3 {
+			return nil, fmt.Errorf("Invalid autoban rule: %v", args)
+		}
+		status, err := strconv.Atoi(rest[0])
+		if err != nil || status < 100 || status > 599 {
+			return nil, fmt.Errorf("Invalid autoban status: %s", rest[0])
+		}
+		rule.Status = status
+		rest = rest[1:]
+	case "path":
+		if len(rest) < 3 {
+			return nil, fmt.Errorf("Invalid autoban rule: %v", args)
+		}
+		rule.Paths = rest[2:]
+		rest = rest[:2]
+	default:
+		return nil, fmt.Errorf("Autoban rule should be 'requests', 'status' or 'path': %s", rule.Kind)
+	}
+
+	count, err := strconv.Atoi(rest[0])
+	if err != nil || count <= 0 {
+		return nil, fmt.Errorf("Invalid autoban count: %s", rest[0])
+	}
+	window, err := time.ParseDuration(rest[1])
+	if err != nil || window <= 0 {
+		return nil, fmt.Errorf("Invalid autoban window: %s", rest[1])
+	}
+	rule.Count = count
+	rule.Window = window
+	return rule, nil
+}
+
+// clientNet returns the network tracked, and banned, for clientIP.
+func (a *Autoban) clientNet(clientIP net.IP) *net.IPNet {
+	if ip4 := clientIP.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	mask := net.CIDRMask(a.IPv6Prefix, 128)
+	return &net.IPNet{IP: clientIP.Mask(mask), Mask: mask}
+}
+
+// Request counts a request from clientIP before it is served.
+func (a *Autoban) Request(clientIP net.IP, r *http.Request) {
+	for _, rule := range a.Rules {
+		switch rule.Kind {
+		case "requests":
+			a.hit(rule, clientIP)
+		case "path":
+			for _, p := range rule.Paths {
+				if httpserver.Path(r.URL.Path).Matches(p) {
+					a.hit(rule, clientIP)
+					break
+				}
+			}
+		}
+	}
+}
+
+// Response counts the status of a response sent to clientIP.
+func (a *Autoban) Response(clientIP net.IP, status int) {
+	for _, rule := range a.Rules {
+		if rule.Kind == "status" && rule.Status == status {
+			a.hit(rule, clientIP)
+		}
+	}
+}
+
+// hit records a hit on rule and bans the client once it goes over the
+// threshold.
+func (a *Autoban) hit(rule *AutobanRule, clientIP net.IP) {
+	ipnet := a.clientNet(clientIP)
+	key := ipnet.String()
+	now := time.Now()
+
+	rule.mu.Lock()
+	if now.After(rule.nextPrune) {
+		for k, w := range rule.hits {
+			if now.Sub(w.start) > rule.Window {
+				delete(rule.hits, k)
+			}
+		}
+		rule.nextPrune = now.Add(rule.Window)
+	}
+	w, ok := rule.hits[key]
+	if !ok || now.Sub(w.start) > rule.Window {
+		w = &autobanWindow{start: now}
+		rule.hits[key] = w
+	}
+	w.count++
+	exceeded := w.count > rule.Count
+	if exceeded {
+		delete(rule.hits, key)
+	}
+	rule.mu.Unlock()
+
+	if exceeded {
+		a.Bans.Add(Ban{
+			Net:     ipnet,
+			Reason:  "autoban: " + rule.String(),
+			Created: now,
+			Expires: now.Add(a.TTL),
+		})
+	}
+}
+
+// String describes the rule.
+func (rule *AutobanRule) String() string {
+	switch rule.Kind {
+	case "status":
+		return fmt.Sprintf("more than %d responses with status %d in %s", rule.Count, rule.Status, rule.Window)
+	case "path":
+		return fmt.Sprintf("more than %d requests to %v in %s", rule.Count, rule.Paths, rule.Window)
+	}
+	return fmt.Sprintf("more than %d requests in %s", rule.Count, rule.Window)
+}
@@ -0,0 +1,137 @@
+package ipfilter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+func TestAutoban(t *testing.T) {
+	TestCases := []struct {
+		inputIpfilterConfig string
+		requests            []string // "<remote addr> <path> [x-forwarded-for]"
+		expectedStatus      []int
+	}{
+		// Too many requests.
+		{`ipfilter / {
+			rule block
+			ip 192.0.2.1
+			autoban requests 2 1m
+			autoban_list autobantest1
+		}`,
+			[]string{"10.0.0.1:_ /", "10.0.0.1:_ /", "10.0.0.2:_ /", "10.0.0.1:_ /", "10.0.0.1:_ /", "10.0.0.2:_ /"},
+			[]int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusOK, http.StatusForbidden, http.StatusOK},
+		},
+		// Too many 404s, IPv6 clients are tracked per /64.
+		{`ipfilter / {
+			rule block
+			ip 192.0.2.1
+			autoban status 404 1 1m
+			autoban_list autobantest2
+		}`,
+			[]string{"[2001:db8::1]:_ /missing", "[2001:db8::2]:_ /missing", "[2001:db8::3]:_ /", "[2001:db8:1::1]:_ /"},
+			[]int{http.StatusNotFound, http.StatusNotFound, http.StatusForbidden, http.StatusOK},
+		},
+		// Too many hits on listed paths.
+		{`ipfilter / {
+			rule block
+			ip 192.0.2.1
+			autoban path 1 1m /login /admin
+			autoban_list autobantest3
+		}`,
+			[]string{"10.0.0.1:_ /", "10.0.0.1:_ /", "10.0.0.1:_ /login", "10.0.0.1:_ /admin/x", "10.0.0.1:_ /"},
+			[]int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusOK, http.StatusForbidden},
+		},
+		// Rotating X-Forwarded-For doesn't dodge the ban, nor lets a client
+		// get someone else banned.
+		{`ipfilter / {
+			rule block
+			ip 192.0.2.1
+			autoban requests 2 1m
+			autoban_list autobantest4
+		}`,
+			[]string{"10.0.0.1:_ / 10.0.0.5", "10.0.0.1:_ / 10.0.0.6", "10.0.0.1:_ / 10.0.0.7", "10.0.0.5:_ /", "10.0.0.1:_ / 10.0.0.8"},
+			[]int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusOK, http.StatusForbidden},
+		},
+		// Behind a trusted proxy the forwarded client is tracked.
+		{`ipfilter / {
+			rule block
+			ip 192.0.2.1
+			autoban requests 2 1m
+			autoban_list autobantest5
+			trusted_proxies 10.0.0.1
+		}`,
+			[]string{"10.0.0.1:_ / 10.0.0.5", "10.0.0.1:_ / 10.0.0.6", "10.0.0.1:_ / 10.0.0.5", "10.0.0.1:_ / 10.0.0.5", "10.0.0.1:_ / 10.0.0.5", "10.0.0.1:_ / 10.0.0.6"},
+			[]int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusOK, http.StatusForbidden, http.StatusOK},
+		},
+	}
+
+	for i, tc := range TestCases {
+		c := caddy.NewTestController("http", tc.inputIpfilterConfig)
+		config, err := ipfilterParse(c)
+		if err != nil {
+			t.Fatalf("Test %d: could not parse config: %v", i, err)
+		}
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				if r.URL.Path == "/missing" {
+					return http.StatusNotFound, nil
+				}
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		for j, reqLine := range tc.requests {
+			fields := strings.Fields(reqLine)
+			req, err := http.NewRequest("GET", fields[1], nil)
+			if err != nil {
+				t.Fatalf("Could not create HTTP request: %v", err)
+			}
+			req.RemoteAddr = fields[0]
+			if len(fields) == 3 {
+				req.Header.Set("X-Forwarded-For", fields[2])
+			}
+
+			status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+			if status != tc.expectedStatus[j] {
+				t.Fatalf("Test %d, request %d (%s): expected StatusCode: '%d', Got: '%d'",
+					i, j, reqLine, tc.expectedStatus[j], status)
+			}
+		}
+	}
+}
+
+func TestAutobanParse(t *testing.T) {
+	for i, input := range []string{
+		`ipfilter / {
+			rule block
+			ip 192.0.2.1
+			autoban_ttl 1h
+		}`,
+		`ipfilter / {
+			rule block
+			ip 192.0.2.1
+			autoban sometimes 1 1m
+		}`,
+		`ipfilter / {
+			rule block
+			ip 192.0.2.1
+			autoban status 999 1 1m
+		}`,
+		`ipfilter / {
+			rule block
+			ip 192.0.2.1
+			autoban path 1 1m
+		}`,
+	} {
+		c := caddy.NewTestController("http", input)
+		if _, err := ipfilterParse(c); err == nil {
+			t.Errorf("Test %d didn't error, but it should have", i)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package ipfilter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBanList is the name of the ban list used when none is given.
+const DefaultBanList = "default"
+
+// Ban is a single entry of a BanList.
+type Ban struct {
+	Net     *net.IPNet
+	Reason  string
+	Created time.Time
+	Expires time.Time // Zero if the ban never expires.
+}
+
+// Expired reports whether the ban is no longer in effect at t.
+func (b Ban) Expired(t time.Time) bool {
+	return !b.Expires.IsZero() && !t.Before(b.Expires)
+}
+
+// BanList is a set of banned ranges that can be changed at runtime. The
+// ipfilter blocks referencing it by name all see the same entries.
+type BanList struct {
+	Name string
+
+	mu sync.RWMutex
+	// The bans by prefix length, then by the CIDR notation of Ban.Net, so
+	// a lookup costs a map access per prefix length in use rather than a
+	// scan of every ban.
+	bans      map[banPrefix]map[string]Ban
+	nextPrune time.Time
+}
+
+// banPrefix is the family and length of the ranges banned.
+type banPrefix struct {
+	ones, bits int
+}
+
+// banPruneInterval is how often expired bans are dropped from a list.
+const banPruneInterval = time.Minute
+
+var (
+	banListsMu sync.Mutex
+	banLists   = make(map[string]*BanList)
+)
+
+// GetBanList returns the ban list called name, creating it if needed.
+func GetBanList(name string) *BanList {
+	banListsMu.Lock()
+	defer banListsMu.Unlock()
+
+	l, ok := banLists[name]
+	if !ok {
+		l = &BanList{Name: name, bans: make(map[banPrefix]map[string]Ban)}
+		banLists[name] = l
+	}
+	return l
+}
+
+// parseBanNet parses an address or a CIDR range to ban.
+func parseBanNet(s string) (*net.IPNet, error) {
+	if _, ipnet, err := net.ParseCIDR(s); err == nil {
+		return ipnet, nil
+	}
+	if ip := net.ParseIP(s); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		mask := len(ip) * 8
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(mask, mask)}, nil
+	}
+	return nil, fmt.Errorf("Can't parse IP: %s", s)
+}
+
+// banKey returns where ipnet is stored in a BanList.
+func banKey(ipnet *net.IPNet) (banPrefix, string) {
+	ones, bits := ipnet.Mask.Size()
+	return banPrefix{ones, bits}, ipnet.String()
+}
+
+// Add inserts b in the list, replacing any ban on the same range.
+func (l *BanList) Add(b Ban) {
+	if b.Created.IsZero() {
+		b.Created = time.Now()
+	}
+	prefix, key := banKey(b.Net)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now := time.Now(); now.After(l.nextPrune) {
+		l.pruneLocked(now)
+		l.nextPrune = now.Add(banPruneInterval)
+	}
+	bans, ok := l.bans[prefix]
+	if !ok {
+		bans = make(map[string]Ban)
+		l.bans[prefix] = bans
+	}
+	bans[key] = b
+}
+
+// Remove lifts the ban on cidr and reports whether there was one.
+func (l *BanList) Remove(cidr string) bool {
+	ipnet, err := parseBanNet(cidr)
+	if err != nil {
+		return false
+	}
+	prefix, key := banKey(ipnet)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.bans[prefix][key]; !ok {
+		return false
+	}
+	delete(l.bans[prefix], key)
+	if len(l.bans[prefix]) == 0 {
+		delete(l.bans, prefix)
+	}
+	return true
+}
+
+// List returns the bans in effect, sorted by range.
+func (l *BanList) List() []Ban {
+	now := time.Now()
+
+	l.mu.RLock()
+	var bans []Ban
+	for _, prefixBans := range l.bans {
+		for _, b := range prefixBans {
+			if !b.Expired(now) {
+				bans = append(bans, b)
+			}
+		}
+	}
+	l.mu.RUnlock()
+
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Net.String() < bans[j].Net.String()
+	})
+	return bans
+}
+
+// Match returns the ban in effect for ip, if any. Expired bans are ignored
+// until they're pruned.
+func (l *BanList) Match(ip net.IP) (Ban, bool) {
+	if l == nil {
+		return Ban{}, false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	now := time.Now()
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for prefix, bans := range l.bans {
+		if prefix.bits != len(ip)*8 {
+			continue
+		}
+		ipnet := net.IPNet{IP: ip.Mask(net.CIDRMask(prefix.ones, prefix.bits)), Mask: net.CIDRMask(prefix.ones, prefix.bits)}
+		if b, ok := bans[ipnet.String()]; ok && !b.Expired(now) {
+			return b, true
+		}
+	}
+	return Ban{}, false
+}
+
+// pruneLocked removes the bans which expired at t. l.mu must be held.
+func (l *BanList) pruneLocked(t time.Time) {
+	for prefix, bans := range l.bans {
+		for k, b := range bans {
+			if b.Expired(t) {
+				delete(bans, k)
+			}
+		}
+		if len(bans) == 0 {
+			delete(l.bans, prefix)
+		}
+	}
+}
+
+// LoadDir adds a permanent ban for every address listed in a prefix dir,
+// using the content of the file as the reason.
+func (l *BanList) LoadDir(dir string) error {
+	entries := make(map[string]struct{})
+	if err := scanPrefixLevel(dir, "", 0, entries); err != nil {
+		return err
+	}
+	for entry := range entries {
+		ip := prefixEntryIP(entry)
+		if ip == nil {
+			continue
+		}
+		ipnet, _ := parseBanNet(ip.String())
+		reason, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(entry)))
+		if err != nil {
+			return err
+		}
+		l.Add(Ban{Net: ipnet, Reason: strings.TrimSpace(string(reason))})
+	}
+	return nil
+}
+
+// banFile returns where a ban on a single address is stored in a prefix dir,
+// or "" if ipnet is a range which can't be stored there.
+func banFile(dir string, ipnet *net.IPNet) string {
+	if ones, bits := ipnet.Mask.Size(); ones != bits {
+		return ""
+	}
+	// The last name is in the sharded namespace and, for IPv6, uses
+	// equal-signs which work on every platform.
+	names := prefixDirNames(ipnet.IP)
+	name := names[len(names)-1]
+	return filepath.Join(dir, filepath.FromSlash(name))
+}
+
+// writeBanFile stores a ban on a single address in a prefix dir.
+func writeBanFile(dir string, b Ban) error {
+	fname := banFile(dir, b.Net)
+	if fname == "" {
+		return fmt.Errorf("%s is a range and can't be stored in a prefix dir", b.Net)
+	}
+	if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fname, []byte(b.Reason+"\n"), 0644)
+}
+
+// removeBanFile deletes every file listing the address of ipnet from a
+// prefix dir.
+func removeBanFile(dir string, ipnet *net.IPNet) error {
+	if ones, bits := ipnet.Mask.Size(); ones != bits {
+		return nil
+	}
+	for _, name := range prefixDirNames(ipnet.IP) {
+		err := os.Remove(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
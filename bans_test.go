@@ -0,0 +1,57 @@
+package ipfilter
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBanListMatch(t *testing.T) {
+	l := GetBanList("banstest_match")
+	now := time.Now()
+	for i := 0; i < 1000; i++ {
+		ipnet, _ := parseBanNet(fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+		l.Add(Ban{Net: ipnet, Reason: "flood"})
+	}
+	for _, cidr := range []string{"192.168.0.0/16", "2001:db8::/64", "2001:db8:1::1"} {
+		ipnet, _ := parseBanNet(cidr)
+		l.Add(Ban{Net: ipnet, Reason: cidr})
+	}
+	expired, _ := parseBanNet("172.16.0.1")
+	l.Add(Ban{Net: expired, Created: now.Add(-time.Hour), Expires: now.Add(-time.Minute)})
+
+	TestCases := []struct {
+		ip       string
+		expected string // the range banned, "" if none
+	}{
+		{"10.0.0.0", "10.0.0.0/32"},
+		{"10.0.3.231", "10.0.3.231/32"},
+		{"10.0.3.232", ""},
+		{"::ffff:10.0.1.1", "10.0.1.1/32"},
+		{"192.168.44.1", "192.168.0.0/16"},
+		{"2001:db8::abcd", "2001:db8::/64"},
+		{"2001:db8:0:1::1", ""},
+		{"2001:db8:1::1", "2001:db8:1::1/128"},
+		{"172.16.0.1", ""},
+	}
+	for _, tc := range TestCases {
+		b, ok := l.Match(net.ParseIP(tc.ip))
+		switch {
+		case tc.expected == "" && ok:
+			t.Errorf("%s: expected no ban, got %s", tc.ip, b.Net)
+		case tc.expected != "" && (!ok || b.Net.String() != tc.expected):
+			t.Errorf("%s: expected ban on %s, got %v", tc.ip, tc.expected, b.Net)
+		}
+	}
+
+	if n := len(l.List()); n != 1003 {
+		t.Errorf("Expected 1003 bans in effect, got %d", n)
+	}
+	if !l.Remove("192.168.0.0/16") || l.Remove("192.168.0.0/16") {
+		t.Error("Expected the range to be removed once")
+	}
+	if _, ok := l.Match(net.ParseIP("192.168.44.1")); ok {
+		t.Error("Expected the lifted ban not to match")
+	}
+}
@@ -0,0 +1,227 @@
+package ipfilter
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	htmltemplate "html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+// blockPageData is what block page templates are rendered with.
+type blockPageData struct {
+	ClientIP   string
+	Country    string
+	Reason     string
+	Scope      string
+	RequestID  string
+	Time       time.Time
+	Status     int    // The status the page is sent with.
+	StatusText string // Its text, e.g. "Forbidden".
+}
+
+// pageTemplate is a parsed block page, either an html or a text template.
+type pageTemplate interface {
+	Execute(io.Writer, interface{}) error
+}
+
+// pageFuncs are the functions available to block page templates.
+var pageFuncs = map[string]interface{}{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// Block page variants, by media type.
+const (
+	mediaHTML = "text/html"
+	mediaJSON = "application/json"
+	mediaText = "text/plain"
+)
+
+// contentTypes maps the block page variants to their Content-Type.
+var contentTypes = map[string]string{
+	mediaHTML: "text/html; charset=utf-8",
+	mediaJSON: "application/json",
+	mediaText: "text/plain; charset=utf-8",
+}
+
+// The variants used when a block page is configured but not for the media
+// type the client prefers.
+var (
+	defaultJSONPage = texttemplate.Must(texttemplate.New("json").Funcs(pageFuncs).Parse(
+		`{"error":{{json .StatusText}},"reason":{{json .Reason}},"request_id":{{json .RequestID}}}` + "\n"))
+	defaultTextPage = texttemplate.Must(texttemplate.New("text").Parse(
+		"{{.StatusText}}\nRequest ID: {{.RequestID}}\n"))
+)
+
+// pageCache holds the parsed block pages, keyed by media type and file name,
+// so blocking a request doesn't read the file again.
+var pageCache sync.Map
+
+// loadPage parses the block page file for a media type and caches it.
+func loadPage(media, file string) (pageTemplate, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var tmpl pageTemplate
+	if media == mediaHTML {
+		tmpl, err = htmltemplate.New(file).Funcs(pageFuncs).Parse(string(content))
+	} else {
+		tmpl, err = texttemplate.New(file).Funcs(pageFuncs).Parse(string(content))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pageCache.Store(media+" "+file, tmpl)
+	return tmpl, nil
+}
+
+// getPage returns the cached block page, loading it on first use.
+func getPage(media, file string) (pageTemplate, error) {
+	if tmpl, ok := pageCache.Load(media + " " + file); ok {
+		return tmpl.(pageTemplate), nil
+	}
+	return loadPage(media, file)
+}
+
+// pageFiles returns the block page files of path by media type.
+func pageFiles(path IPPath) map[string]string {
+	files := make(map[string]string)
+	if path.BlockPage != "" {
+		files[mediaHTML] = path.BlockPage
+	}
+	if path.BlockPageJSON != "" {
+		files[mediaJSON] = path.BlockPageJSON
+	}
+	if path.BlockPageText != "" {
+		files[mediaText] = path.BlockPageText
+	}
+	return files
+}
+
+// negotiate picks the media type of the block page to send according to the
+// Accept header. HTML is preferred when the client has no preference.
+func negotiate(accept string) string {
+	if accept == "" {
+		return mediaHTML
+	}
+
+	best, bestQ := mediaHTML, -1.0
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		media := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+
+		var candidate string
+		switch media {
+		case "text/html", "application/xhtml+xml", "*/*", "text/*":
+			candidate = mediaHTML
+		case "application/json", "application/*", "application/problem+json":
+			candidate = mediaJSON
+		case "text/plain":
+			candidate = mediaText
+		default:
+			continue
+		}
+		if q > bestQ {
+			best, bestQ = candidate, q
+		}
+	}
+	return best
+}
+
+// requestID returns the ID of the request, as set by the request_id
+// directive or a proxy in front of the server, or a new random one.
+func requestID(r *http.Request) string {
+	if id, _ := r.Context().Value(httpserver.RequestIDCtxKey).(string); id != "" {
+		return id
+	}
+	if id := r.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// renderBlockPage renders the block page variant of path best suited to r.
+// It returns false if path has no block page.
+func renderBlockPage(r *http.Request, d Decision, info clientInfo) (string, []byte, bool, error) {
+	files := pageFiles(d.Path)
+	if len(files) == 0 {
+		return "", nil, false, nil
+	}
+
+	media := negotiate(r.Header.Get("Accept"))
+	var tmpl pageTemplate
+	if file, ok := files[media]; ok {
+		var err error
+		if tmpl, err = getPage(media, file); err != nil {
+			return "", nil, true, err
+		}
+	} else {
+		switch media {
+		case mediaJSON:
+			tmpl = defaultJSONPage
+		case mediaText:
+			tmpl = defaultTextPage
+		default:
+			// Only the JSON or text variants are configured.
+			media = mediaJSON
+			if _, ok := files[media]; !ok {
+				media = mediaText
+			}
+			var err error
+			if tmpl, err = getPage(media, files[media]); err != nil {
+				return "", nil, true, err
+			}
+		}
+	}
+
+	// Without a status the page is sent as a successful response.
+	status := d.Path.BlockStatus
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if d.RequestID == "" {
+		d.RequestID = requestID(r)
+	}
+	data := blockPageData{
+		ClientIP:   info.field("client_ip"),
+		Country:    info.Country,
+		Reason:     d.Reason,
+		Scope:      d.Scope,
+		RequestID:  d.RequestID,
+		Time:       time.Now(),
+		Status:     status,
+		StatusText: http.StatusText(status),
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", nil, true, err
+	}
+	return contentTypes[media], buf.Bytes(), true, nil
+}
@@ -0,0 +1,300 @@
+package ipfilter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+func TestNegotiate(t *testing.T) {
+	for accept, expected := range map[string]string{
+		"":                                  mediaHTML,
+		"*/*":                               mediaHTML,
+		"text/html,application/xhtml+xml":   mediaHTML,
+		"application/json":                  mediaJSON,
+		"text/plain":                        mediaText,
+		"text/html;q=0.5, application/json": mediaJSON,
+		"application/json;q=0.1, text/*":    mediaHTML,
+		"image/png":                         mediaHTML,
+	} {
+		if got := negotiate(accept); got != expected {
+			t.Errorf("Accept %q: expected %s, got %s", accept, expected, got)
+		}
+	}
+}
+
+func TestBlockPageTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	htmlPage := filepath.Join(dir, "blocked.html")
+	jsonPage := filepath.Join(dir, "blocked.json")
+	if err := ioutil.WriteFile(htmlPage, []byte(`<p>{{.ClientIP}} from {{.Country}}: {{.Reason}} ({{.RequestID}})</p>`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(jsonPage, []byte(`{"error": "blocked", "country": {{json .Country}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := caddy.NewTestController("http", fmt.Sprintf(`ipfilter / {
+		rule block
+		database %s
+		country CN
+		blockpage %s
+		blockpage_json %s
+	}`, DataBase, htmlPage, jsonPage))
+	config, err := ipfilterParse(c)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+	ipf := IPFilter{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+
+	TestCases := []struct {
+		accept              string
+		expectedContentType string
+		expectedBody        string
+	}{
+		{"text/html", "text/html; charset=utf-8", "<p>42.48.120.7 from CN: country (abc&lt;1&gt;)</p>"},
+		{"application/json", "application/json", `{"error": "blocked", "country": "CN"}`},
+		// Without a status the page is sent as a successful response.
+		{"text/plain", "text/plain; charset=utf-8", "OK\nRequest ID: abc<1>\n"},
+	}
+
+	for i, tc := range TestCases {
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = "42.48.120.7:_"
+		req.Header.Set("Accept", tc.accept)
+		req.Header.Set("X-Request-Id", "abc<1>")
+
+		rec := httptest.NewRecorder()
+		if status, err := ipf.ServeHTTP(rec, req); err != nil || status != http.StatusOK {
+			t.Fatalf("Test %d: expected the block page, got %d, %v", i, status, err)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != tc.expectedContentType {
+			t.Errorf("Test %d: expected Content-Type %q, got %q", i, tc.expectedContentType, ct)
+		}
+		if body := rec.Body.String(); body != tc.expectedBody {
+			t.Errorf("Test %d: expected body %q, got %q", i, tc.expectedBody, body)
+		}
+	}
+}
+
+func TestBlockPageRequestID(t *testing.T) {
+	c := caddy.NewTestController("http", fmt.Sprintf(`ipfilter / {
+		rule block
+		ip 10.0.0.1
+		blockpage %s
+		log stdout
+	}`, BlockPage))
+	config, err := ipfilterParse(c)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+	var buf bytes.Buffer
+	config.DecisionLog.logger = httpserver.NewTestLogger(&buf)
+	ipf := IPFilter{Config: config}
+
+	TestCases := []struct {
+		ctxID    string // As set by the request_id directive.
+		headerID string
+		expected string // Random if empty.
+	}{
+		{"ctx", "header", "ctx"},
+		{"", "header", "header"},
+		{"", "", ""},
+	}
+
+	for i, tc := range TestCases {
+		buf.Reset()
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = "10.0.0.1:_"
+		req.Header.Set("Accept", "text/plain")
+		if tc.headerID != "" {
+			req.Header.Set("X-Request-Id", tc.headerID)
+		}
+		if tc.ctxID != "" {
+			req = req.WithContext(context.WithValue(req.Context(), httpserver.RequestIDCtxKey, tc.ctxID))
+		}
+
+		rec := httptest.NewRecorder()
+		ipf.ServeHTTP(rec, req)
+		var entry decisionEntry
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Fatalf("Test %d: invalid log line %q: %v", i, buf.String(), err)
+		}
+		if tc.expected != "" && entry.RequestID != tc.expected {
+			t.Errorf("Test %d: expected request ID %q, got %q", i, tc.expected, entry.RequestID)
+		}
+		if page := rec.Body.String(); entry.RequestID == "" || !strings.HasSuffix(page, "Request ID: "+entry.RequestID+"\n") {
+			t.Errorf("Test %d: expected the page to show the logged request ID %q, got %q", i, entry.RequestID, page)
+		}
+	}
+}
+
+func TestBlockResponse(t *testing.T) {
+	TestCases := []struct {
+		inputIpfilterConfig string
+		expectedStatus      int
+		expectedCode        int // As written to the response.
+		expectedHeaders     map[string]string
+	}{
+		{fmt.Sprintf(`ipfilter / {
+			rule block
+			ip 10.0.0.1
+			blockpage %s
+			status 451
+			header Link "<https://example.com/legal>; rel=\"blocked-by\""
+		}`, BlockPage), 0, http.StatusUnavailableForLegalReasons, map[string]string{
+			"Link": `<https://example.com/legal>; rel="blocked-by"`,
+		}},
+		{`ipfilter / {
+			rule block
+			ip 10.0.0.1
+			status 429
+			retry_after 90s
+			header Cache-Control no-store
+		}`, http.StatusTooManyRequests, http.StatusOK, map[string]string{
+			"Retry-After":   "90",
+			"Cache-Control": "no-store",
+		}},
+		{`ipfilter / {
+			rule block
+			ip 10.0.0.1
+			status 404
+			retry_after 30
+		}`, http.StatusNotFound, http.StatusOK, map[string]string{
+			"Retry-After": "30",
+		}},
+	}
+
+	for i, tc := range TestCases {
+		c := caddy.NewTestController("http", tc.inputIpfilterConfig)
+		config, err := ipfilterParse(c)
+		if err != nil {
+			t.Fatalf("Test %d: could not parse config: %v", i, err)
+		}
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = "10.0.0.1:_"
+
+		rec := httptest.NewRecorder()
+		status, _ := ipf.ServeHTTP(rec, req)
+		if status != tc.expectedStatus {
+			t.Errorf("Test %d: expected status %d, got %d", i, tc.expectedStatus, status)
+		}
+		if rec.Code != tc.expectedCode {
+			t.Errorf("Test %d: expected written status %d, got %d", i, tc.expectedCode, rec.Code)
+		}
+		for name, value := range tc.expectedHeaders {
+			if got := rec.Header().Get(name); got != value {
+				t.Errorf("Test %d: expected header %s: %q, got %q", i, name, value, got)
+			}
+		}
+	}
+}
+
+func TestDefaultBlockPageStatus(t *testing.T) {
+	c := caddy.NewTestController("http", fmt.Sprintf(`ipfilter / {
+		rule block
+		ip 10.0.0.1
+		blockpage %s
+		status 429
+	}`, BlockPage))
+	config, err := ipfilterParse(c)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+	ipf := IPFilter{Config: config}
+
+	TestCases := []struct {
+		accept       string
+		expectedBody string
+	}{
+		{"application/json", `{"error":"Too Many Requests","reason":"ip","request_id":"abc"}` + "\n"},
+		{"text/plain", "Too Many Requests\nRequest ID: abc\n"},
+	}
+
+	for i, tc := range TestCases {
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = "10.0.0.1:_"
+		req.Header.Set("Accept", tc.accept)
+		req.Header.Set("X-Request-Id", "abc")
+
+		rec := httptest.NewRecorder()
+		ipf.ServeHTTP(rec, req)
+		if rec.Code != http.StatusTooManyRequests {
+			t.Errorf("Test %d: expected written status %d, got %d", i, http.StatusTooManyRequests, rec.Code)
+		}
+		if body := rec.Body.String(); body != tc.expectedBody {
+			t.Errorf("Test %d: expected body %q, got %q", i, tc.expectedBody, body)
+		}
+	}
+}
+
+func TestRetryAfterBan(t *testing.T) {
+	c := caddy.NewTestController("http", `ipfilter / {
+		rule block
+		bans retryaftertest
+		retry_after 1h
+	}`)
+	config, err := ipfilterParse(c)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+	ipnet, _ := parseBanNet("10.0.0.1")
+	GetBanList("retryaftertest").Add(Ban{Net: ipnet, Expires: time.Now().Add(2 * time.Minute)})
+
+	ipf := IPFilter{Config: config}
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("Could not create HTTP request: %v", err)
+	}
+	req.RemoteAddr = "10.0.0.1:_"
+
+	rec := httptest.NewRecorder()
+	if status, _ := ipf.ServeHTTP(rec, req); status != http.StatusForbidden {
+		t.Fatalf("Expected status %d, got %d", http.StatusForbidden, status)
+	}
+	// The time left on the ban, rather than the configured default.
+	if got := rec.Header().Get("Retry-After"); got != "120" {
+		t.Errorf("Expected Retry-After: 120, got %q", got)
+	}
+}
@@ -0,0 +1,163 @@
+package ipfilter
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultBotTTL is how long the verification of a client is cached.
+	defaultBotTTL = time.Hour
+	// botErrorTTL is how long a failed verification is cached, so a broken
+	// DNS server doesn't cost lookups on every request.
+	botErrorTTL = time.Minute
+	// botVerifyTimeout bounds the lookups made while a request waits.
+	botVerifyTimeout = 2 * time.Second
+	// maxBotEntries bounds the number of clients cached.
+	maxBotEntries = 10000
+)
+
+// crawlerAgents are the words found in the User-Agent of the crawlers. Only
+// the clients claiming to be one are verified, the others can't be.
+var crawlerAgents = []string{"bot", "crawl", "spider", "slurp", "facebookexternalhit", "mediapartners-google", "feedfetcher", "bingpreview"}
+
+// claimsCrawler reports whether the User-Agent ua is a crawler's.
+func claimsCrawler(ua string) bool {
+	ua = strings.ToLower(ua)
+	for _, word := range crawlerAgents {
+		if strings.Contains(ua, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// BotVerifier checks the hostnames of clients with forward-confirmed reverse
+// DNS: the names the address points to are only trusted if they resolve
+// back to the address. Results are cached by address, the least recently
+// used being dropped first.
+type BotVerifier struct {
+	Resolver Resolver
+	TTL      time.Duration
+	Size     int // The number of clients cached.
+
+	mu       sync.Mutex
+	lru      *list.List // Of *botEntry, most recently used first.
+	entries  map[string]*list.Element
+	inflight map[string]*botCall
+}
+
+// botEntry is the cached verification of a client.
+type botEntry struct {
+	key     string
+	names   []string
+	expires time.Time
+}
+
+// botCall is a verification in progress, shared by the requests of a client
+// arriving meanwhile.
+type botCall struct {
+	done  chan struct{}
+	names []string
+}
+
+// newBotVerifier returns a BotVerifier with the defaults set.
+func newBotVerifier() *BotVerifier {
+	return &BotVerifier{
+		TTL:      defaultBotTTL,
+		Size:     maxBotEntries,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		inflight: make(map[string]*botCall),
+	}
+}
+
+// Verify returns the hostnames of ip confirmed by a forward lookup,
+// lower-cased and without the trailing dot.
+func (v *BotVerifier) Verify(ip net.IP) []string {
+	key := canonicalIP(ip)
+	now := time.Now()
+
+	v.mu.Lock()
+	if el, ok := v.entries[key]; ok {
+		e := el.Value.(*botEntry)
+		if now.Before(e.expires) {
+			v.lru.MoveToFront(el)
+			v.mu.Unlock()
+			return e.names
+		}
+		v.lru.Remove(el)
+		delete(v.entries, key)
+	}
+	if call, ok := v.inflight[key]; ok {
+		v.mu.Unlock()
+		<-call.done
+		return call.names
+	}
+	call := &botCall{done: make(chan struct{})}
+	v.inflight[key] = call
+	v.mu.Unlock()
+
+	names, err := v.lookup(ip)
+	e := &botEntry{key: key, names: names, expires: now.Add(v.TTL)}
+	if err != nil {
+		e.expires = now.Add(botErrorTTL)
+	}
+
+	v.mu.Lock()
+	delete(v.inflight, key)
+	v.entries[key] = v.lru.PushFront(e)
+	for v.lru.Len() > v.Size {
+		oldest := v.lru.Back()
+		v.lru.Remove(oldest)
+		delete(v.entries, oldest.Value.(*botEntry).key)
+	}
+	v.mu.Unlock()
+
+	call.names = names
+	close(call.done)
+	return names
+}
+
+// lookup does the reverse lookup of ip and confirms each name it finds.
+func (v *BotVerifier) lookup(ip net.IP) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), botVerifyTimeout)
+	defer cancel()
+
+	ptrs, err := v.Resolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, ptr := range ptrs {
+		name := strings.ToLower(strings.TrimSuffix(ptr, "."))
+		addrs, err := v.Resolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	return names, nil
+}
+
+// matchBotDomain returns the first of names under one of the domains.
+func matchBotDomain(names, domains []string) (string, bool) {
+	for _, name := range names {
+		for _, domain := range domains {
+			if name == domain || strings.HasSuffix(name, "."+domain) {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
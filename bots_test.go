@@ -0,0 +1,165 @@
+package ipfilter
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+func TestVerifiedBot(t *testing.T) {
+	c := caddy.NewTestController("http", `ipfilter / {
+		rule allow
+		ip 10.0.0.0/8
+		verified_bot googlebot.com .search.msn.com.
+	}`)
+	config, err := ipfilterParse(c)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+	if expected := []string{"googlebot.com", "search.msn.com"}; !reflect.DeepEqual(config.Paths[0].VerifiedBots, expected) {
+		t.Errorf("Expected domains %v, got %v", expected, config.Paths[0].VerifiedBots)
+	}
+
+	resolver := &stubResolver{
+		hosts: map[string][]string{
+			"crawl-66-249-66-1.googlebot.com":   {"66.249.66.1"},
+			"msnbot-157-55-39-1.search.msn.com": {"157.55.39.1"},
+			"fake.googlebot.com":                {"192.0.2.1"},
+			"crawler.example.com":               {"198.51.100.9"},
+		},
+		ptrs: map[string][]string{
+			"66.249.66.1":  {"crawl-66-249-66-1.googlebot.com."},
+			"157.55.39.1":  {"MSNBOT-157-55-39-1.SEARCH.MSN.COM."},
+			"203.0.113.5":  {"fake.googlebot.com."},
+			"198.51.100.9": {"crawler.example.com."},
+		},
+	}
+	config.Bots.Resolver = resolver
+
+	ipf := IPFilter{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+	googlebot := "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+	bingbot := "Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)"
+	TestCases := []struct {
+		reqIP          string
+		userAgent      string
+		expectedStatus int
+	}{
+		{"66.249.66.1:_", googlebot, http.StatusOK},
+		{"157.55.39.1:_", bingbot, http.StatusOK},
+		{"10.0.0.1:_", "curl/7.64.0", http.StatusOK},
+		// Not looked up without a crawler's User-Agent.
+		{"66.249.66.1:_", "curl/7.64.0", http.StatusForbidden},
+		// The PTR record is spoofed, the name doesn't resolve back.
+		{"203.0.113.5:_", googlebot, http.StatusForbidden},
+		// Confirmed, but not a crawler we allow.
+		{"198.51.100.9:_", googlebot, http.StatusForbidden},
+		// No PTR record.
+		{"8.8.8.8:_", googlebot, http.StatusForbidden},
+	}
+	for i, tc := range TestCases {
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = tc.reqIP
+		req.Header.Set("User-Agent", tc.userAgent)
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != tc.expectedStatus {
+			t.Errorf("Test %d failed. Expected StatusCode: '%d', Got: '%d'", i, tc.expectedStatus, status)
+		}
+	}
+
+	// The verification is cached.
+	resolver.mu.Lock()
+	delete(resolver.ptrs, "66.249.66.1")
+	resolver.mu.Unlock()
+	if names := config.Bots.Verify(net.ParseIP("66.249.66.1")); len(names) != 1 {
+		t.Errorf("Expected the cached verification, got %v", names)
+	}
+}
+
+// countingResolver counts the reverse lookups, which take delay.
+type countingResolver struct {
+	stubResolver
+	delay   time.Duration
+	lookups int32
+}
+
+func (r *countingResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	atomic.AddInt32(&r.lookups, 1)
+	time.Sleep(r.delay)
+	return r.stubResolver.LookupAddr(ctx, addr)
+}
+
+func TestBotVerifierLookups(t *testing.T) {
+	resolver := &countingResolver{
+		stubResolver: stubResolver{
+			hosts: map[string][]string{"crawl-66-249-66-1.googlebot.com": {"66.249.66.1"}},
+			ptrs:  map[string][]string{"66.249.66.1": {"crawl-66-249-66-1.googlebot.com."}},
+		},
+		delay: 50 * time.Millisecond,
+	}
+	v := newBotVerifier()
+	v.Resolver = resolver
+	v.Size = 2
+
+	// The requests arriving during a lookup wait for it.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if names := v.Verify(net.ParseIP("66.249.66.1")); len(names) != 1 {
+				t.Errorf("Expected the client to be verified, got %v", names)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&resolver.lookups); n != 1 {
+		t.Errorf("Expected a single lookup, got %d", n)
+	}
+
+	// The least recently used client is dropped when the cache is full.
+	resolver.delay = 0
+	v.Verify(net.ParseIP("192.0.2.1"))
+	v.Verify(net.ParseIP("66.249.66.1"))
+	v.Verify(net.ParseIP("192.0.2.2"))
+	atomic.StoreInt32(&resolver.lookups, 0)
+	v.Verify(net.ParseIP("66.249.66.1"))
+	v.Verify(net.ParseIP("192.0.2.2"))
+	if n := atomic.LoadInt32(&resolver.lookups); n != 0 {
+		t.Errorf("Expected the recently used clients to be cached, got %d lookups", n)
+	}
+	v.Verify(net.ParseIP("192.0.2.1"))
+	if n := atomic.LoadInt32(&resolver.lookups); n != 1 {
+		t.Errorf("Expected the least recently used client to be dropped, got %d lookups", n)
+	}
+}
+
+func TestClaimsCrawler(t *testing.T) {
+	for ua, expected := range map[string]bool{
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)":               true,
+		"Mozilla/5.0 (compatible; Baiduspider/2.0; +http://www.baidu.com/search/spider.html)":    true,
+		"Mozilla/5.0 (compatible; Yahoo! Slurp; http://help.yahoo.com/help/us/ysearch/slurp)":    true,
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 Chrome/76.0 Safari/537.36": false,
+		"": false,
+	} {
+		if got := claimsCrawler(ua); got != expected {
+			t.Errorf("Expected %q to claim to be a crawler: %t, got %t", ua, expected, got)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package ipfilter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+// Default names of the cookie and header carrying a bypass token.
+const (
+	defaultBypassCookie = "ipfilter_bypass"
+	defaultBypassHeader = "X-Ipfilter-Bypass"
+)
+
+// minBypassSecret is the shortest secret accepted, in bytes. Anyone guessing
+// the secret can mint tokens passing every block.
+const minBypassSecret = 32
+
+// Bypass lets the requests carrying a valid signed token through the
+// ipfilter blocks.
+type Bypass struct {
+	Secret []byte
+	Cookie string
+	Header string
+}
+
+// newBypass returns a Bypass checking tokens signed with secret.
+func newBypass(secret string) *Bypass {
+	return &Bypass{
+		Secret: []byte(secret),
+		Cookie: defaultBypassCookie,
+		Header: defaultBypassHeader,
+	}
+}
+
+var errInvalidToken = errors.New("invalid bypass token")
+
+// MintBypassToken returns a token valid until expires for the requests whose
+// path is in scope, or for every request if scope is empty.
+func MintBypassToken(secret []byte, scope string, expires time.Time) string {
+	payload := strconv.FormatInt(expires.Unix(), 10) + "|" + scope
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(signBypass(secret, payload))
+}
+
+// VerifyBypassToken checks the signature and expiry of token and returns
+// the scope it's bound to.
+func VerifyBypassToken(secret []byte, token string, now time.Time) (string, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return "", errInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", errInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, signBypass(secret, string(payload))) {
+		return "", errInvalidToken
+	}
+
+	fields := strings.SplitN(string(payload), "|", 2)
+	if len(fields) != 2 {
+		return "", errInvalidToken
+	}
+	expires, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || now.Unix() >= expires {
+		return "", errInvalidToken
+	}
+	return fields[1], nil
+}
+
+// signBypass returns the signature of a token payload.
+func signBypass(secret []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// Valid reports whether r carries a valid token for its path.
+func (b *Bypass) Valid(r *http.Request) bool {
+	if b == nil {
+		return false
+	}
+
+	token := r.Header.Get(b.Header)
+	if token == "" {
+		if cookie, err := r.Cookie(b.Cookie); err == nil {
+			token = cookie.Value
+		}
+	}
+	if token == "" {
+		return false
+	}
+
+	scope, err := VerifyBypassToken(b.Secret, token, time.Now())
+	if err != nil {
+		return false
+	}
+	return scope == "" || httpserver.Path(r.URL.Path).Matches(scope)
+}
@@ -0,0 +1,115 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+func TestBypassToken(t *testing.T) {
+	secret := []byte("s3cret")
+	now := time.Now()
+
+	token := MintBypassToken(secret, "/private", now.Add(time.Hour))
+	scope, err := VerifyBypassToken(secret, token, now)
+	if err != nil || scope != "/private" {
+		t.Fatalf("Expected a valid token for /private, got %q, %v", scope, err)
+	}
+
+	if _, err := VerifyBypassToken([]byte("other"), token, now); err == nil {
+		t.Error("Expected a token signed with another secret to be rejected")
+	}
+	if _, err := VerifyBypassToken(secret, token, now.Add(2*time.Hour)); err == nil {
+		t.Error("Expected an expired token to be rejected")
+	}
+	tampered := MintBypassToken(secret, "", now.Add(time.Hour))
+	tampered = token[:strings.Index(token, ".")] + tampered[strings.Index(tampered, "."):]
+	if _, err := VerifyBypassToken(secret, tampered, now); err == nil {
+		t.Error("Expected a tampered token to be rejected")
+	}
+}
+
+func TestBypass(t *testing.T) {
+	c := caddy.NewTestController("http", `ipfilter / {
+		rule block
+		ip 8.8.8.8
+		bypass 7c6f2a91d04e5b38a1f9e2c7d6b5a4f3
+		bypass_header X-Pass
+		admin /_ipfilter
+		admin_token admin
+	}`)
+	config, err := ipfilterParse(c)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+	ipf := IPFilter{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+
+	// Mint a token through the admin endpoint.
+	req, _ := http.NewRequest(http.MethodPost, "/_ipfilter/tokens", strings.NewReader(`{"scope":"/private","ttl":"1h"}`))
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("Authorization", "Bearer admin")
+	rec := httptest.NewRecorder()
+	if status, _ := ipf.ServeHTTP(rec, req); status != http.StatusCreated {
+		t.Fatalf("Expected token to be minted, got status %d", status)
+	}
+	var minted struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &minted); err != nil {
+		t.Fatal(err)
+	}
+	unscoped := MintBypassToken([]byte("7c6f2a91d04e5b38a1f9e2c7d6b5a4f3"), "", time.Now().Add(time.Hour))
+
+	TestCases := []struct {
+		path   string
+		header string
+		cookie string
+		expect int
+	}{
+		{"/private", "", "", http.StatusForbidden},
+		{"/private", minted.Token, "", http.StatusOK},
+		{"/private/page", minted.Token, "", http.StatusOK},
+		{"/public", minted.Token, "", http.StatusForbidden},
+		{"/public", "", unscoped, http.StatusOK},
+		{"/private", "garbage", "", http.StatusForbidden},
+	}
+	for _, tc := range TestCases {
+		req, _ := http.NewRequest(http.MethodGet, tc.path, nil)
+		req.RemoteAddr = "8.8.8.8:1234"
+		if tc.header != "" {
+			req.Header.Set("X-Pass", tc.header)
+		}
+		if tc.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: defaultBypassCookie, Value: tc.cookie})
+		}
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != tc.expect {
+			t.Errorf("%s (header %t, cookie %t): expected status %d, got %d",
+				tc.path, tc.header != "", tc.cookie != "", tc.expect, status)
+		}
+	}
+}
+
+func TestBypassParse(t *testing.T) {
+	for _, secret := range []string{`""`, "s3cret", "7c6f2a91d04e5b38a1f9e2c7d6b5a4f"} {
+		c := caddy.NewTestController("http", `ipfilter / {
+			rule block
+			ip 8.8.8.8
+			bypass `+secret+`
+		}`)
+		if _, err := ipfilterParse(c); err == nil {
+			t.Errorf("Expected the bypass secret %s to be too short", secret)
+		}
+	}
+}
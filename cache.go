@@ -0,0 +1,133 @@
+package ipfilter
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// defaultCacheTTL is how long a cached result is used for.
+const defaultCacheTTL = time.Minute
+
+// Cache keeps the results of the database lookups of recently seen clients,
+// so steady traffic from the same addresses doesn't decode the database
+// again. The prefix_dir checks aren't cached, a file dropped there must take
+// effect right away. It holds at most Size entries, dropping the least
+// recently used ones.
+type Cache struct {
+	Size int
+	TTL  time.Duration
+
+	mu      sync.Mutex
+	lru     *list.List // Of *cacheEntry, most recently used first.
+	entries map[string]*list.Element
+
+	hits, misses, evictions uint64
+}
+
+// cacheEntry is a single cached result.
+type cacheEntry struct {
+	key     string
+	expires time.Time
+	rec     geoRecord // Result of a database lookup.
+}
+
+// newCache returns an empty Cache.
+func newCache(size int, ttl time.Duration) *Cache {
+	if ttl <= 0 {
+		ttl = defaultCacheTTL
+	}
+	return &Cache{
+		Size:    size,
+		TTL:     ttl,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the entry cached under key, if it hasn't expired.
+func (c *Cache) get(key string) (cacheEntry, bool) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if ok && now.After(el.Value.(*cacheEntry).expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return cacheEntry{}, false
+	}
+	c.hits++
+	c.lru.MoveToFront(el)
+	return *el.Value.(*cacheEntry), true
+}
+
+// add caches e, evicting the least recently used entry if the cache is full.
+func (c *Cache) add(e cacheEntry) {
+	e.expires = time.Now().Add(c.TTL)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		*el.Value.(*cacheEntry) = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[e.key] = c.lru.PushFront(&e)
+	for c.lru.Len() > c.Size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+		c.evictions++
+	}
+}
+
+// Purge drops every cached result. It's called when the configuration they
+// were looked up for stops.
+func (c *Cache) Purge() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+	c.mu.Unlock()
+	return nil
+}
+
+// stats returns the counters of the cache and its number of entries.
+func (c *Cache) stats() (hits, misses, evictions uint64, entries int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses, c.evictions, c.lru.Len()
+}
+
+// lookupDB looks ip up in db, going through the cache if there is one. kind
+// tells the databases apart in the cache.
+func (ipf IPFilter) lookupDB(kind string, db *maxminddb.Reader, ip net.IP) (geoRecord, error) {
+	cache := ipf.Config.Cache
+	if cache == nil {
+		var rec geoRecord
+		err := db.Lookup(ip, &rec)
+		return rec, err
+	}
+
+	key := kind + " " + canonicalIP(ip)
+	if e, ok := cache.get(key); ok {
+		return e.rec, nil
+	}
+	var rec geoRecord
+	if err := db.Lookup(ip, &rec); err != nil {
+		// Errors aren't cached, the next request tries again.
+		return rec, err
+	}
+	cache.add(cacheEntry{key: key, rec: rec})
+	return rec, nil
+}
@@ -0,0 +1,98 @@
+package ipfilter
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy"
+)
+
+func TestCacheLRU(t *testing.T) {
+	c := newCache(2, time.Hour)
+	c.add(cacheEntry{key: "a"})
+	c.add(cacheEntry{key: "b"})
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("Expected a to be cached")
+	}
+	// b is now the least recently used.
+	c.add(cacheEntry{key: "c"})
+	if _, ok := c.get("b"); ok {
+		t.Error("Expected b to be evicted")
+	}
+	if e, ok := c.get("a"); !ok || e.key != "a" {
+		t.Error("Expected a to be kept")
+	}
+
+	hits, misses, evictions, entries := c.stats()
+	if hits != 2 || misses != 1 || evictions != 1 || entries != 2 {
+		t.Errorf("Unexpected stats: %d hits, %d misses, %d evictions, %d entries", hits, misses, evictions, entries)
+	}
+
+	c.Purge()
+	if _, ok := c.get("a"); ok {
+		t.Error("Expected the cache to be empty after a purge")
+	}
+
+	c = newCache(2, time.Nanosecond)
+	c.add(cacheEntry{key: "a"})
+	time.Sleep(time.Millisecond)
+	if _, ok := c.get("a"); ok {
+		t.Error("Expected a to expire")
+	}
+}
+
+func TestCachedLookups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := caddy.NewTestController("http", `ipfilter / {
+		rule block
+		database `+DataBase+`
+		country RU
+		prefix_dir `+dir+`
+		cache 100 1h
+		metrics /metrics 127.0.0.1
+	}`)
+	config, err := ipfilterParse(c)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+	ipf := IPFilter{Config: config}
+	path := config.Paths[0]
+	ip := net.ParseIP("24.53.192.20")
+
+	if ipf.PrefixDirBlocked(ip, path) {
+		t.Fatal("Expected the address not to be listed")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ip.String()), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// prefix_dir checks aren't cached, dropping a file bans right away.
+	if !ipf.PrefixDirBlocked(ip, path) {
+		t.Error("Expected the address to be listed")
+	}
+
+	for i := 0; i < 2; i++ {
+		rec, err := ipf.lookupDB("country", config.DBHandler, ip)
+		if err != nil || rec.Country.ISOCode != "CA" {
+			t.Fatalf("Expected CA, got %q, %v", rec.Country.ISOCode, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	config.Metrics.write(&buf, config)
+	for _, want := range []string{"ipfilter_cache_hits_total 1", "ipfilter_cache_misses_total 1", "ipfilter_cache_entries 1"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected %q in the metrics:\n%s", want, buf.String())
+		}
+	}
+}
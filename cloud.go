@@ -0,0 +1,221 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// cloudRange is a range published by a cloud provider.
+type cloudRange struct {
+	CIDR     string
+	Services []string
+	Region   string
+}
+
+// cloudLoaders decode the range files published by the cloud providers.
+var cloudLoaders = map[string]func([]byte) ([]cloudRange, error){
+	"aws":    loadAWSRanges,
+	"gcp":    loadGCPRanges,
+	"azure":  loadAzureRanges,
+	"oracle": loadOracleRanges,
+}
+
+// loadAWSRanges decodes https://ip-ranges.amazonaws.com/ip-ranges.json.
+func loadAWSRanges(data []byte) ([]cloudRange, error) {
+	var file struct {
+		Prefixes []struct {
+			IPPrefix string `json:"ip_prefix"`
+			Region   string `json:"region"`
+			Service  string `json:"service"`
+		} `json:"prefixes"`
+		IPv6Prefixes []struct {
+			IPv6Prefix string `json:"ipv6_prefix"`
+			Region     string `json:"region"`
+			Service    string `json:"service"`
+		} `json:"ipv6_prefixes"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	var ranges []cloudRange
+	for _, p := range file.Prefixes {
+		ranges = append(ranges, cloudRange{p.IPPrefix, []string{p.Service}, p.Region})
+	}
+	for _, p := range file.IPv6Prefixes {
+		ranges = append(ranges, cloudRange{p.IPv6Prefix, []string{p.Service}, p.Region})
+	}
+	return ranges, nil
+}
+
+// loadGCPRanges decodes https://www.gstatic.com/ipranges/cloud.json.
+func loadGCPRanges(data []byte) ([]cloudRange, error) {
+	var file struct {
+		Prefixes []struct {
+			IPv4Prefix string `json:"ipv4Prefix"`
+			IPv6Prefix string `json:"ipv6Prefix"`
+			Service    string `json:"service"`
+			Scope      string `json:"scope"`
+		} `json:"prefixes"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	var ranges []cloudRange
+	for _, p := range file.Prefixes {
+		cidr := p.IPv4Prefix
+		if cidr == "" {
+			cidr = p.IPv6Prefix
+		}
+		ranges = append(ranges, cloudRange{cidr, []string{p.Service}, p.Scope})
+	}
+	return ranges, nil
+}
+
+// loadAzureRanges decodes the Azure Service Tags files, e.g.
+// ServiceTags_Public_<date>.json. A tag's service is matched by its name,
+// e.g. "AzureFrontDoor.Backend", by the part before the region or variant,
+// e.g. "AzureFrontDoor", or by its system service.
+func loadAzureRanges(data []byte) ([]cloudRange, error) {
+	var file struct {
+		Values []struct {
+			Name       string `json:"name"`
+			Properties struct {
+				Region          string   `json:"region"`
+				SystemService   string   `json:"systemService"`
+				AddressPrefixes []string `json:"addressPrefixes"`
+			} `json:"properties"`
+		} `json:"values"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	var ranges []cloudRange
+	for _, v := range file.Values {
+		services := []string{v.Name}
+		if i := strings.IndexByte(v.Name, '.'); i > 0 {
+			services = append(services, v.Name[:i])
+		}
+		if v.Properties.SystemService != "" {
+			services = append(services, v.Properties.SystemService)
+		}
+		for _, cidr := range v.Properties.AddressPrefixes {
+			ranges = append(ranges, cloudRange{cidr, services, v.Properties.Region})
+		}
+	}
+	return ranges, nil
+}
+
+// loadOracleRanges decodes
+// https://docs.oracle.com/en-us/iaas/tools/public_ip_ranges.json, whose
+// tags are used as services.
+func loadOracleRanges(data []byte) ([]cloudRange, error) {
+	var file struct {
+		Regions []struct {
+			Region string `json:"region"`
+			CIDRs  []struct {
+				CIDR string   `json:"cidr"`
+				Tags []string `json:"tags"`
+			} `json:"cidrs"`
+		} `json:"regions"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	var ranges []cloudRange
+	for _, r := range file.Regions {
+		for _, c := range r.CIDRs {
+			ranges = append(ranges, cloudRange{c.CIDR, c.Tags, r.Region})
+		}
+	}
+	return ranges, nil
+}
+
+// cloudFilter selects the ranges of some services and regions. An empty
+// list selects everything.
+type cloudFilter struct {
+	Services []string
+	Regions  []string
+}
+
+// parseCloudFilters parses the "service=a,b" and "region=c,d" arguments of
+// a cloud directive.
+func parseCloudFilters(args []string) (cloudFilter, error) {
+	var f cloudFilter
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return f, fmt.Errorf("Invalid cloud filter: %s", arg)
+		}
+		values := strings.Split(kv[1], ",")
+		switch kv[0] {
+		case "service":
+			f.Services = append(f.Services, values...)
+		case "region":
+			f.Regions = append(f.Regions, values...)
+		default:
+			return f, fmt.Errorf("Cloud filter should be 'service' or 'region': %s", arg)
+		}
+	}
+	return f, nil
+}
+
+// matches reports whether the filter selects r. Names are compared without
+// regard to case.
+func (f cloudFilter) matches(r cloudRange) bool {
+	return matchesAny(f.Services, r.Services...) && matchesAny(f.Regions, r.Region)
+}
+
+// matchesAny reports whether one of values is in names, or names is empty.
+func matchesAny(names []string, values ...string) bool {
+	if len(names) == 0 {
+		return true
+	}
+	for _, name := range names {
+		for _, v := range values {
+			if strings.EqualFold(name, v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// loadCloudRanges reads the ranges file of provider and returns the ranges
+// selected by filter.
+func loadCloudRanges(provider, fname string, filter cloudFilter) ([]*net.IPNet, error) {
+	load, ok := cloudLoaders[provider]
+	if !ok {
+		return nil, fmt.Errorf("Cloud provider should be 'aws', 'gcp', 'azure' or 'oracle': %s", provider)
+	}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	ranges, err := load(data)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read %s ranges from %s: %v", provider, fname, err)
+	}
+
+	var nets []*net.IPNet
+	for _, r := range ranges {
+		if !filter.matches(r) {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(r.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("Can't read %s ranges from %s: %v", provider, fname, err)
+		}
+		nets = append(nets, ipnet)
+	}
+	if len(nets) == 0 {
+		return nil, fmt.Errorf("No %s ranges in %s match the filters", provider, fname)
+	}
+	return nets, nil
+}
@@ -0,0 +1,104 @@
+package ipfilter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+func TestCloudRanges(t *testing.T) {
+	TestCases := []struct {
+		provider string
+		file     string
+		filters  []string
+		expected []string
+	}{
+		{"aws", "testdata/cloud/aws.json", nil,
+			[]string{"3.5.140.0/22", "18.200.0.0/16", "52.95.245.0/24", "2a05:d018::/36"}},
+		{"aws", "testdata/cloud/aws.json", []string{"service=elb", "region=eu-west-1"},
+			[]string{"52.95.245.0/24", "2a05:d018::/36"}},
+		{"aws", "testdata/cloud/aws.json", []string{"service=EC2,AMAZON"},
+			[]string{"3.5.140.0/22", "18.200.0.0/16"}},
+		{"gcp", "testdata/cloud/gcp.json", []string{"region=europe-west1"},
+			[]string{"34.76.0.0/14", "2600:1900:4010::/44"}},
+		{"azure", "testdata/cloud/azure.json", []string{"service=AzureFrontDoor"},
+			[]string{"147.243.0.0/16", "2a01:111:2050::/44"}},
+		{"azure", "testdata/cloud/azure.json", []string{"service=AzureCloud", "region=westeurope"},
+			[]string{"13.69.0.0/17"}},
+		{"oracle", "testdata/cloud/oracle.json", []string{"service=OCI"},
+			[]string{"129.146.0.0/21", "130.61.0.0/16"}},
+		{"oracle", "testdata/cloud/oracle.json", []string{"region=us-phoenix-1", "service=object_storage"},
+			[]string{"134.70.8.0/21"}},
+	}
+
+	for i, tc := range TestCases {
+		filter, err := parseCloudFilters(tc.filters)
+		if err != nil {
+			t.Fatalf("Test %d: can't parse filters: %v", i, err)
+		}
+		nets, err := loadCloudRanges(tc.provider, tc.file, filter)
+		if err != nil {
+			t.Fatalf("Test %d: can't load ranges: %v", i, err)
+		}
+		var actual []string
+		for _, ipnet := range nets {
+			actual = append(actual, ipnet.String())
+		}
+		if !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("Test %d: expected %v, got %v", i, tc.expected, actual)
+		}
+	}
+
+	if _, err := parseCloudFilters([]string{"zone=a"}); err == nil {
+		t.Error("Expected an unknown filter to be rejected")
+	}
+	if _, err := loadCloudRanges("ibm", "testdata/cloud/aws.json", cloudFilter{}); err == nil {
+		t.Error("Expected an unknown provider to be rejected")
+	}
+	if _, err := loadCloudRanges("aws", "testdata/cloud/aws.json", cloudFilter{Regions: []string{"mars-1"}}); err == nil {
+		t.Error("Expected a filter matching nothing to be reported")
+	}
+}
+
+func TestCloudDirective(t *testing.T) {
+	c := caddy.NewTestController("http", `ipfilter / {
+		rule allow
+		cloud aws testdata/cloud/aws.json service=ELB region=eu-west-1
+		ip 10.0.0.1
+	}`)
+	config, err := ipfilterParse(c)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+	ipf := IPFilter{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+
+	TestCases := []struct {
+		reqIP          string
+		expectedStatus int
+	}{
+		{"52.95.245.10:_", http.StatusOK},
+		{"[2a05:d018::1]:_", http.StatusOK},
+		{"10.0.0.1:_", http.StatusOK},
+		{"18.200.0.1:_", http.StatusForbidden},
+	}
+	for i, tc := range TestCases {
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = tc.reqIP
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != tc.expectedStatus {
+			t.Errorf("Test %d failed. Expected StatusCode: '%d', Got: '%d'", i, tc.expectedStatus, status)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+// DecisionLog writes the decisions made on requests as JSON lines.
+type DecisionLog struct {
+	Output  string  // A file name, "stdout", "stderr", "syslog" or "caddy".
+	Sample  float64 // Fraction of the decisions logged.
+	Allowed bool    // Also log the requests allowed by a block.
+
+	logger *httpserver.Logger // nil when logging to Caddy's log.
+}
+
+// decisionEntry is a line of the decision log.
+type decisionEntry struct {
+	Time      time.Time `json:"ts"`
+	ClientIP  string    `json:"client_ip,omitempty"`
+	Source    string    `json:"source,omitempty"`
+	Country   string    `json:"country,omitempty"`
+	Block     int       `json:"block"`
+	Scope     string    `json:"scope,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Entry     string    `json:"entry,omitempty"`
+	Rule      string    `json:"rule,omitempty"`
+	Mode      string    `json:"mode"`
+	Decision  string    `json:"decision"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	URI       string    `json:"uri"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// newDecisionLog returns a DecisionLog logging every decision to output.
+func newDecisionLog(output string) *DecisionLog {
+	l := &DecisionLog{Output: output, Sample: 1}
+	if output != "caddy" {
+		l.logger = &httpserver.Logger{Output: output}
+	}
+	return l
+}
+
+// Log writes d, made on r, to the log if it has to be.
+func (l *DecisionLog) Log(r *http.Request, d Decision) {
+	if l == nil {
+		return
+	}
+	if d.Allow && (!l.Allowed || d.Scope == "") {
+		return
+	}
+	if l.Sample < 1 && rand.Float64() >= l.Sample {
+		return
+	}
+
+	entry := decisionEntry{
+		Time:      time.Now().UTC(),
+		Source:    d.Source,
+		Country:   d.Country,
+		Block:     d.Index,
+		Scope:     d.Scope,
+		Reason:    d.Reason,
+		Entry:     d.Entry,
+		Mode:      "enforce",
+		Decision:  decisionString(d.Allow),
+		Method:    r.Method,
+		Host:      r.Host,
+		URI:       r.URL.RequestURI(),
+		UserAgent: r.UserAgent(),
+		RequestID: d.RequestID,
+	}
+	if d.ClientIP != nil {
+		entry.ClientIP = d.ClientIP.String()
+	}
+	if d.Index >= 0 {
+		entry.Rule = "allow"
+		if d.Path.IsBlock {
+			entry.Rule = "block"
+		}
+		if d.Path.ReportOnly {
+			entry.Mode = "report"
+		}
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Println("ipfilter: Can't log decision:", err)
+		return
+	}
+	if l.logger == nil {
+		log.Println(string(line))
+		return
+	}
+	l.logger.Println(string(line))
+}
@@ -0,0 +1,92 @@
+package ipfilter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+func TestDecisionLog(t *testing.T) {
+	c := caddy.NewTestController("http", `ipfilter / {
+		rule block
+		ip 10.0.0.0/8
+		log ipfilter.log
+		rotate_size 10
+	}
+	ipfilter /open {
+		rule allow
+		ip 10.0.0.1
+		log_allowed
+	}`)
+	config, err := ipfilterParse(c)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+	if config.DecisionLog.logger.Roller == nil || config.DecisionLog.logger.Roller.MaxSize != 10 {
+		t.Errorf("Expected the log roller to be configured")
+	}
+
+	var buf bytes.Buffer
+	config.DecisionLog.logger = httpserver.NewTestLogger(&buf)
+	ipf := IPFilter{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+
+	for _, tc := range []struct{ remote, fwdFor, path, id string }{
+		{"10.0.0.1:_", "", "/", "3f1c6b2e"},
+		{"192.168.0.1:_", "10.0.0.1", "/open", ""},
+		{"192.168.0.1:_", "", "/", ""},
+	} {
+		req, err := http.NewRequest("GET", tc.path, nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = tc.remote
+		req.Header.Set("User-Agent", "tester")
+		if tc.fwdFor != "" {
+			req.Header.Set("X-Forwarded-For", tc.fwdFor)
+		}
+		if tc.id != "" {
+			// As set by the request_id directive.
+			req = req.WithContext(context.WithValue(req.Context(), httpserver.RequestIDCtxKey, tc.id))
+		}
+		ipf.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 log lines, got %d: %q", len(lines), buf.String())
+	}
+
+	var blocked, allowed decisionEntry
+	if err := json.Unmarshal([]byte(lines[0]), &blocked); err != nil {
+		t.Fatalf("Invalid log line %q: %v", lines[0], err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &allowed); err != nil {
+		t.Fatalf("Invalid log line %q: %v", lines[1], err)
+	}
+
+	expected := decisionEntry{
+		ClientIP: "10.0.0.1", Source: "RemoteAddr", Block: 0, Scope: "/",
+		Reason: "ip", Entry: "10.0.0.0/8", Rule: "block", Mode: "enforce",
+		Decision: "block", Method: "GET", URI: "/", UserAgent: "tester",
+		RequestID: "3f1c6b2e",
+	}
+	blocked.Time = expected.Time
+	if blocked != expected {
+		t.Errorf("Expected blocked entry %+v, got %+v", expected, blocked)
+	}
+	if allowed.Decision != "allow" || allowed.Source != "X-Forwarded-For" || allowed.Block != 1 || allowed.Entry != "10.0.0.1/32" || allowed.RequestID == "" {
+		t.Errorf("Unexpected allowed entry %+v", allowed)
+	}
+}
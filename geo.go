@@ -0,0 +1,100 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+// geoRecord holds what ipfilter uses out of the 'mmdb' databases. The same
+// record decodes both the country and the ASN databases.
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN   uint   `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+// clientInfo is what is known about the client of a request.
+type clientInfo struct {
+	IP      net.IP
+	Country string
+	ASN     string
+	ASOrg   string
+}
+
+// clientInfo gathers what is known about the client of the request of s.
+// Whichever block matched, the client is the one the site wide features
+// see, so the placeholders and enrich headers don't depend on the path.
+func (ipf IPFilter) clientInfo(s *requestState) clientInfo {
+	var info clientInfo
+	info.IP, _ = s.clientIP(sourceSite)
+	if info.IP == nil {
+		return info
+	}
+
+	info.Country, _ = s.country(sourceSite)
+	if rec, _ := s.asn(sourceSite); rec.ASN != 0 {
+		info.ASN = strconv.FormatUint(uint64(rec.ASN), 10)
+		info.ASOrg = rec.ASOrg
+	}
+	return info
+}
+
+// field returns the value of one of the enrich fields.
+func (info clientInfo) field(name string) string {
+	switch name {
+	case "client_ip":
+		if info.IP == nil {
+			return ""
+		}
+		return info.IP.String()
+	case "country":
+		return info.Country
+	case "asn":
+		return info.ASN
+	case "asn_org":
+		return info.ASOrg
+	}
+	return ""
+}
+
+// enrichFields are the fields which can be passed upstream by enrich.
+var enrichFields = map[string]bool{"client_ip": true, "country": true, "asn": true, "asn_org": true}
+
+// Enrichment is a request header set to a field of the clientInfo.
+type Enrichment struct {
+	Field  string
+	Header string
+}
+
+// enrich sets the enrichment headers of r, replacing any copy sent by the
+// client.
+func (ipf IPFilter) enrich(r *http.Request, info clientInfo) {
+	for _, e := range ipf.Config.Enrich {
+		r.Header.Del(e.Header)
+		if v := info.field(e.Field); v != "" {
+			r.Header.Set(e.Header, v)
+		}
+	}
+}
+
+// setPlaceholders makes the outcome of d available to the other directives
+// through the request's replacer.
+func (ipf IPFilter) setPlaceholders(r *http.Request, d Decision, info clientInfo) {
+	repl, ok := r.Context().Value(httpserver.ReplacerCtxKey).(httpserver.Replacer)
+	if !ok {
+		return
+	}
+
+	repl.Set("ipfilter_client_ip", info.field("client_ip"))
+	repl.Set("ipfilter_country", info.Country)
+	repl.Set("ipfilter_asn", info.ASN)
+	repl.Set("ipfilter_asn_org", info.ASOrg)
+	repl.Set("ipfilter_decision", decisionString(d.Allow))
+	repl.Set("ipfilter_matched_scope", d.Scope)
+	repl.Set("ipfilter_reason", d.Reason)
+}
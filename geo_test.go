@@ -0,0 +1,188 @@
+package ipfilter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+func TestPlaceholders(t *testing.T) {
+	c := caddy.NewTestController("http", fmt.Sprintf(`ipfilter /private {
+		rule block
+		database %s
+		country CN
+	}`, DataBase))
+	config, err := ipfilterParse(c)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+
+	TestCases := []struct {
+		reqIP    string
+		reqPath  string
+		expected string
+	}{
+		{"42.48.120.7:_", "/private", "42.48.120.7 CN  block /private country"},
+		{"8.8.8.8:_", "/private", "8.8.8.8 US  allow /private "},
+		// The country is looked up even when no block needs it.
+		{"24.53.192.20:_", "/public", "24.53.192.20 CA  allow  "},
+	}
+
+	for i, tc := range TestCases {
+		var got string
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				repl := r.Context().Value(httpserver.ReplacerCtxKey).(httpserver.Replacer)
+				got = repl.Replace("{ipfilter_client_ip} {ipfilter_country} {ipfilter_asn} {ipfilter_decision} {ipfilter_matched_scope} {ipfilter_reason}")
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		req, err := http.NewRequest("GET", tc.reqPath, nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = tc.reqIP
+		repl := httpserver.NewReplacer(req, nil, "")
+		req = req.WithContext(context.WithValue(req.Context(), httpserver.ReplacerCtxKey, repl))
+
+		ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if got == "" {
+			// Blocked, check the placeholders as a log would.
+			got = repl.Replace("{ipfilter_client_ip} {ipfilter_country} {ipfilter_asn} {ipfilter_decision} {ipfilter_matched_scope} {ipfilter_reason}")
+		}
+		if got != tc.expected {
+			t.Errorf("Test %d: expected placeholders %q, got %q", i, tc.expected, got)
+		}
+	}
+}
+
+func TestEnrich(t *testing.T) {
+	// The country database has no ASN, so X-ASN is only stripped.
+	c := caddy.NewTestController("http", fmt.Sprintf(`ipfilter / {
+		database %s
+		asn_database %s
+		enrich country X-Country-Code
+		enrich asn X-ASN
+		enrich client_ip X-Client-IP
+	}`, DataBase, DataBase))
+	config, err := ipfilterParse(c)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+
+	var got http.Header
+	ipf := IPFilter{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			got = r.Header
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("Could not create HTTP request: %v", err)
+	}
+	req.RemoteAddr = "24.53.192.20:_"
+	req.Header.Set("X-Country-Code", "US")
+	req.Header.Set("X-ASN", "15169")
+
+	if status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req); status != http.StatusOK {
+		t.Fatalf("Expected the request to pass, got status %d", status)
+	}
+	if v := got.Get("X-Country-Code"); v != "CA" {
+		t.Errorf("Expected X-Country-Code: CA, got %q", v)
+	}
+	if v, ok := got["X-Asn"]; ok {
+		t.Errorf("Expected client supplied X-ASN to be stripped, got %q", v)
+	}
+	if v := got.Get("X-Client-IP"); v != "24.53.192.20" {
+		t.Errorf("Expected X-Client-IP: 24.53.192.20, got %q", v)
+	}
+
+	c = caddy.NewTestController("http", `ipfilter / {
+		enrich city X-City
+	}`)
+	if _, err := ipfilterParse(c); err == nil {
+		t.Errorf("Expected an unknown enrich field to be an error")
+	}
+
+	// The fields looked up in a database need that database.
+	for _, config := range []string{
+		`ipfilter / {
+			enrich country X-Country-Code
+		}`,
+		fmt.Sprintf(`ipfilter / {
+			database %s
+			enrich asn X-ASN
+		}`, DataBase),
+		fmt.Sprintf(`ipfilter / {
+			database %s
+			enrich asn_org X-ASN-Org
+		}`, DataBase),
+	} {
+		c = caddy.NewTestController("http", config)
+		if _, err := ipfilterParse(c); err == nil {
+			t.Errorf("Expected enrich without its database to be an error: %s", config)
+		}
+	}
+}
+
+func TestEnrichClient(t *testing.T) {
+	TestCases := []struct {
+		trustedProxies string
+		reqPath        string
+		expected       string
+	}{
+		// The same client whether the block's scope matches or not.
+		{"", "/admin", "8.8.8.8 US"},
+		{"", "/other", "8.8.8.8 US"},
+		{"trusted_proxies 8.8.8.8", "/admin", "24.53.192.20 CA"},
+		{"trusted_proxies 8.8.8.8", "/other", "24.53.192.20 CA"},
+	}
+
+	for i, tc := range TestCases {
+		c := caddy.NewTestController("http", fmt.Sprintf(`ipfilter /admin {
+			database %s
+			enrich client_ip X-Client-IP
+			enrich country X-Country-Code
+			%s
+		}`, DataBase, tc.trustedProxies))
+		config, err := ipfilterParse(c)
+		if err != nil {
+			t.Fatalf("Test %d: could not parse config: %v", i, err)
+		}
+
+		var got, placeholders string
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				got = r.Header.Get("X-Client-IP") + " " + r.Header.Get("X-Country-Code")
+				repl := r.Context().Value(httpserver.ReplacerCtxKey).(httpserver.Replacer)
+				placeholders = repl.Replace("{ipfilter_client_ip} {ipfilter_country}")
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		req, err := http.NewRequest("GET", tc.reqPath, nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = "8.8.8.8:_"
+		req.Header.Set("X-Forwarded-For", "24.53.192.20")
+		repl := httpserver.NewReplacer(req, nil, "")
+		req = req.WithContext(context.WithValue(req.Context(), httpserver.ReplacerCtxKey, repl))
+
+		ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if got != tc.expected || placeholders != tc.expected {
+			t.Errorf("Test %d: expected %q, got headers %q and placeholders %q", i, tc.expected, got, placeholders)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+const (
+	// DefaultHoneypotList is the ban list honeypot adds clients to.
+	DefaultHoneypotList = "honeypot"
+	// defaultHoneypotTTL is how long a client hitting a honeypot is banned.
+	defaultHoneypotTTL = 24 * time.Hour
+)
+
+// Honeypot bans the clients requesting paths nobody legitimate would.
+type Honeypot struct {
+	Paths []string
+	TTL   time.Duration
+	Bans  *BanList
+}
+
+// newHoneypot returns a Honeypot with the defaults set.
+func newHoneypot() *Honeypot {
+	return &Honeypot{
+		TTL:  defaultHoneypotTTL,
+		Bans: GetBanList(DefaultHoneypotList),
+	}
+}
+
+// Matches reports whether r is for one of the honeypot paths.
+func (h *Honeypot) Matches(r *http.Request) bool {
+	for _, p := range h.Paths {
+		if httpserver.Path(r.URL.Path).Matches(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Trap bans clientIP for requesting path.
+func (h *Honeypot) Trap(clientIP net.IP, path string) {
+	ipnet, _ := parseBanNet(clientIP.String())
+	now := time.Now()
+	h.Bans.Add(Ban{
+		Net:     ipnet,
+		Reason:  "honeypot: " + path,
+		Created: now,
+		Expires: now.Add(h.TTL),
+	})
+}
@@ -0,0 +1,75 @@
+package ipfilter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+func TestHoneypot(t *testing.T) {
+	c := caddy.NewTestController("http", `ipfilter /private {
+		rule allow
+		ip 10.0.0.0/8
+		honeypot /wp-login.php /.env
+		honeypot_list honeypottest
+		trusted_proxies 192.168.0.0/16
+	}
+	ipfilter /public {
+		rule block
+		ip 192.0.2.1
+	}`)
+	config, err := ipfilterParse(c)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+	ipf := IPFilter{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+
+	TestCases := []struct {
+		reqIP          string
+		fwdFor         string
+		reqPath        string
+		expectedStatus int
+	}{
+		{"10.0.0.1:_", "", "/private", http.StatusOK},
+		{"10.0.0.1:_", "", "/public", http.StatusOK},
+		{"10.0.0.1:_", "", "/.env", http.StatusForbidden},
+		// Banned on every block, even the one allowing it.
+		{"10.0.0.1:_", "", "/private", http.StatusForbidden},
+		{"10.0.0.1:_", "", "/public", http.StatusForbidden},
+		// X-Forwarded-For is ignored unless it comes from a trusted proxy.
+		{"10.0.0.2:_", "10.0.0.3", "/wp-login.php", http.StatusForbidden},
+		{"10.0.0.2:_", "", "/public", http.StatusForbidden},
+		{"10.0.0.3:_", "", "/public", http.StatusOK},
+		{"10.0.0.4:_", "10.0.0.2", "/public", http.StatusOK},
+		// The client is the last address the trusted proxies forwarded for.
+		{"192.168.0.1:_", "10.0.0.3, 10.0.0.5, 192.168.0.2", "/.env", http.StatusForbidden},
+		{"10.0.0.5:_", "", "/public", http.StatusForbidden},
+		{"10.0.0.3:_", "", "/public", http.StatusOK},
+		{"192.168.0.1:_", "10.0.0.5", "/public", http.StatusForbidden},
+		{"192.168.0.1:_", "", "/public", http.StatusOK},
+	}
+
+	for i, tc := range TestCases {
+		req, err := http.NewRequest("GET", tc.reqPath, nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = tc.reqIP
+		if tc.fwdFor != "" {
+			req.Header.Set("X-Forwarded-For", tc.fwdFor)
+		}
+
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != tc.expectedStatus {
+			t.Fatalf("Test %d: expected StatusCode: '%d', Got: '%d'", i, tc.expectedStatus, status)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package ipfilter
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// hostPrefix marks the hostnames given to the ip directive.
+	hostPrefix = "host:"
+	// defaultHostTTL is how often hostnames are resolved again.
+	defaultHostTTL = 5 * time.Minute
+	// resolveTimeout bounds each DNS lookup.
+	resolveTimeout = 10 * time.Second
+)
+
+// Resolver looks up hostnames and addresses. *net.Resolver satisfies it.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// newResolver returns a Resolver querying the DNS server at addr, or the
+// system's resolver if addr is empty.
+func newResolver(addr string) Resolver {
+	if addr == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// hostNet is an address a hostname resolved to.
+type hostNet struct {
+	Host string
+	Net  *net.IPNet
+}
+
+// HostSet holds the addresses of hostnames, resolved again every TTL in the
+// background. Requests are matched against the last addresses found, which
+// are swapped atomically.
+type HostSet struct {
+	Names    []string
+	TTL      time.Duration
+	Resolver Resolver
+
+	nets     atomic.Value // []hostNet
+	mu       sync.Mutex   // Serializes the refreshes.
+	resolved map[string][]hostNet
+
+	stop chan struct{}
+	once sync.Once
+}
+
+// newHostSet returns an empty HostSet.
+func newHostSet() *HostSet {
+	hs := &HostSet{
+		TTL:      defaultHostTTL,
+		resolved: make(map[string][]hostNet),
+		stop:     make(chan struct{}),
+	}
+	hs.nets.Store([]hostNet(nil))
+	return hs
+}
+
+// Match returns the hostname whose addresses contain ip, if any.
+func (hs *HostSet) Match(ip net.IP) (hostNet, bool) {
+	if hs == nil {
+		return hostNet{}, false
+	}
+	for _, hn := range hs.nets.Load().([]hostNet) {
+		if hn.Net.Contains(ip) {
+			return hn, true
+		}
+	}
+	return hostNet{}, false
+}
+
+// Len returns the number of addresses the hostnames resolved to.
+func (hs *HostSet) Len() int {
+	if hs == nil {
+		return 0
+	}
+	return len(hs.nets.Load().([]hostNet))
+}
+
+// Refresh resolves the hostnames again. A hostname which can't be resolved
+// keeps the addresses it had.
+func (hs *HostSet) Refresh() {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	for _, name := range hs.Names {
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		addrs, err := hs.Resolver.LookupIPAddr(ctx, name)
+		cancel()
+		if err != nil {
+			log.Printf("ipfilter: Can't resolve %s: %v", name, err)
+			continue
+		}
+
+		nets := make([]hostNet, 0, len(addrs))
+		for _, addr := range addrs {
+			ip := addr.IP
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			mask := len(ip) * 8
+			nets = append(nets, hostNet{name, &net.IPNet{IP: ip, Mask: net.CIDRMask(mask, mask)}})
+		}
+		hs.resolved[name] = nets
+	}
+
+	var all []hostNet
+	for _, name := range hs.Names {
+		all = append(all, hs.resolved[name]...)
+	}
+	hs.nets.Store(all)
+}
+
+// Start resolves the hostnames and keeps them up to date until Stop is
+// called.
+func (hs *HostSet) Start() error {
+	hs.Refresh()
+	go func() {
+		ticker := time.NewTicker(hs.TTL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-hs.stop:
+				return
+			case <-ticker.C:
+				hs.Refresh()
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop ends the background refreshes.
+func (hs *HostSet) Stop() error {
+	hs.once.Do(func() { close(hs.stop) })
+	return nil
+}
@@ -0,0 +1,188 @@
+package ipfilter
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+// stubResolver answers from maps, which tests can change.
+type stubResolver struct {
+	mu    sync.Mutex
+	hosts map[string][]string
+	ptrs  map[string][]string
+}
+
+func (r *stubResolver) set(host string, ips ...string) {
+	r.mu.Lock()
+	r.hosts[host] = ips
+	r.mu.Unlock()
+}
+
+func (r *stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ips, ok := r.hosts[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func (r *stubResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names, ok := r.ptrs[addr]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return names, nil
+}
+
+func TestHosts(t *testing.T) {
+	c := caddy.NewTestController("http", `ipfilter / {
+		rule allow
+		ip 10.0.0.1 host:partner.example.com host:egress.example.net
+		host_ttl 1m
+	}`)
+	config, err := ipfilterParse(c)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+	hosts := config.Paths[0].Hosts
+	if hosts == nil || len(hosts.Names) != 2 || hosts.TTL.Minutes() != 1 {
+		t.Fatalf("Unexpected hosts: %+v", hosts)
+	}
+	resolver := &stubResolver{hosts: map[string][]string{
+		"partner.example.com": {"192.0.2.10", "2001:db8::10"},
+	}}
+	hosts.Resolver = resolver
+	hosts.Refresh()
+
+	ipf := IPFilter{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+	check := func(remote string, expected int) {
+		t.Helper()
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = remote
+		if status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req); status != expected {
+			t.Errorf("%s: expected status %d, got %d", remote, expected, status)
+		}
+	}
+
+	check("10.0.0.1:_", http.StatusOK)
+	check("192.0.2.10:_", http.StatusOK)
+	check("[2001:db8::10]:_", http.StatusOK)
+	check("192.0.2.11:_", http.StatusForbidden)
+
+	// The addresses move, and the other host now resolves.
+	resolver.set("partner.example.com", "192.0.2.11")
+	resolver.set("egress.example.net", "198.51.100.1")
+	hosts.Refresh()
+	check("192.0.2.10:_", http.StatusForbidden)
+	check("192.0.2.11:_", http.StatusOK)
+	check("198.51.100.1:_", http.StatusOK)
+
+	// A failing lookup keeps the last addresses.
+	resolver.mu.Lock()
+	delete(resolver.hosts, "partner.example.com")
+	resolver.mu.Unlock()
+	hosts.Refresh()
+	check("192.0.2.11:_", http.StatusOK)
+
+	for _, input := range []string{
+		`ipfilter / {
+			rule allow
+			ip host:
+		}`,
+		`ipfilter / {
+			rule allow
+			ip 10.0.0.1
+			host_ttl 1m
+		}`,
+	} {
+		if _, err := ipfilterParse(caddy.NewTestController("http", input)); err == nil {
+			t.Errorf("Expected an error parsing %s", input)
+		}
+	}
+}
+
+// serveStubDNS answers the A queries it receives on conn with ip.
+func serveStubDNS(conn net.PacketConn, ip net.IP) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n < 12 {
+			continue
+		}
+		// Find the end of the question: the name, the type and the class.
+		end := 12
+		for end < n && buf[end] != 0 {
+			end += int(buf[end]) + 1
+		}
+		end += 5
+		if end > n {
+			continue
+		}
+		qtype := binary.BigEndian.Uint16(buf[end-4:])
+
+		resp := append([]byte(nil), buf[:end]...)
+		resp[2] = 0x81 // response, recursion desired
+		resp[3] = 0x80 // recursion available
+		binary.BigEndian.PutUint16(resp[6:], 0)
+		if qtype == 1 {
+			binary.BigEndian.PutUint16(resp[6:], 1)
+			resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+			resp = append(resp, ip.To4()...)
+		}
+		binary.BigEndian.PutUint16(resp[8:], 0)
+		binary.BigEndian.PutUint16(resp[10:], 0)
+		conn.WriteTo(resp, addr)
+	}
+}
+
+func TestResolverDirective(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Can't listen for DNS queries: %v", err)
+	}
+	defer conn.Close()
+	go serveStubDNS(conn, net.ParseIP("192.0.2.99"))
+
+	c := caddy.NewTestController("http", `ipfilter / {
+		rule allow
+		ip host:partner.example.com
+		resolver `+conn.LocalAddr().String()+`
+	}`)
+	config, err := ipfilterParse(c)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+	hosts := config.Paths[0].Hosts
+	hosts.Refresh()
+	if _, ok := hosts.Match(net.ParseIP("192.0.2.99")); !ok {
+		t.Errorf("Expected the host to resolve through the stub server, got %d addresses", hosts.Len())
+	}
+}
@@ -3,14 +3,16 @@ package ipfilter
 import (
 	"errors"
 	"fmt"
-	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy"
 	"github.com/caddyserver/caddy/caddyhttp/httpserver"
@@ -25,19 +27,57 @@ type IPFilter struct {
 
 // IPPath holds the configuration of a single ipfilter block.
 type IPPath struct {
-	PathScopes   []string
-	BlockPage    string
-	CountryCodes []string
-	PrefixDir    string
-	Nets         []*net.IPNet
-	IsBlock      bool
-	Strict       bool
+	Name          string // Used to label the block in metrics.
+	PathScopes    []string
+	BlockPage     string
+	BlockPageJSON string        // Block page sent to clients preferring JSON.
+	BlockPageText string        // Block page sent to clients preferring plain text.
+	BlockStatus   int           // Status of the block responses, if not the default.
+	BlockHeaders  http.Header   // Headers added to the block responses.
+	RetryAfter    time.Duration // Sent as Retry-After in the block responses.
+	Action        string        // What to do with blocked requests, "block" if empty.
+	RedirectURL   string        // Where the redirect action sends clients.
+	RedirectCode  int           // Status code of the redirect action.
+	TarpitDelay   time.Duration // How long the tarpit action holds requests.
+	CountryCodes  []string
+	PrefixDir     string
+	prefixIndex   *prefixIndex // In-memory copy of PrefixDir if it's indexed.
+	Nets          []*net.IPNet
+	netIndex      *netIndex // Nets, sorted for lookups, once parsed.
+	Bans          *BanList  // Dynamic list of banned ranges, if referenced.
+	Lists         []*IPList // Named lists shared with other blocks.
+	Hosts         *HostSet  // Hostnames given to ip, resolved in the background.
+	VerifiedBots  []string  // Domains of the crawlers matched by their verified hostname.
+	IsBlock       bool
+	Strict        bool
+	ReportOnly    bool   // Only report what the block would do.
+	ReportHeader  string // Response header to report the decision in.
+	OnError       string // "allow", "block" or "error" when the client can't be evaluated.
+	ruleless      bool   // No rule, the block isn't evaluated.
 }
 
 // IPFConfig holds the configuration for the ipfilter middleware.
 type IPFConfig struct {
-	Paths     []IPPath
-	DBHandler *maxminddb.Reader // Database's handler if it gets opened.
+	Paths       []IPPath
+	DBHandler   *maxminddb.Reader // Database's handler if it gets opened.
+	ASNHandler  *maxminddb.Reader // ASN database's handler if it gets opened.
+	Admin       *Admin            // Admin endpoint, if enabled.
+	Autoban     *Autoban          // Automatic banning of offenders, if enabled.
+	Honeypot    *Honeypot         // Paths banning the clients requesting them, if any.
+	Enforced    []*BanList        // Ban lists blocking on every path, whatever the rules.
+	State       *State            // Where the ban lists are saved, if anywhere.
+	DecisionLog *DecisionLog      // Where decisions are logged, if anywhere.
+	Metrics     *Metrics          // Decision counters, if enabled.
+	Enrich      []Enrichment      // Request headers passed upstream.
+	Tarpit      *Tarpit           // Limits the requests held by the tarpit action.
+	Bypass      *Bypass           // Signed tokens letting requests through, if enabled.
+	Cache       *Cache            // Recent lookup results by client IP, if enabled.
+	Resolver    Resolver          // Resolves the hostnames, the system's resolver if nil.
+	Bots        *BotVerifier      // Verifies the hostnames of crawlers, if needed.
+	ListFiles   []string          // Files defining the named lists of the site.
+
+	// Proxies whose X-Forwarded-For is trusted by the site wide features.
+	TrustedProxies []*net.IPNet
 }
 
 // OnlyCountry is used to fetch only the country's code from 'mmdb'.
@@ -58,22 +98,39 @@ func (s *Status) Any() bool {
 }
 
 // block will take care of blocking
-func block(blockPage string, w http.ResponseWriter) (int, error) {
-	if blockPage != "" {
-		bp, err := os.Open(blockPage)
-		if err != nil {
-			return http.StatusInternalServerError, err
+func block(w http.ResponseWriter, r *http.Request, d Decision, info clientInfo) (int, error) {
+	for name, values := range d.Path.BlockHeaders {
+		for _, v := range values {
+			w.Header().Add(name, v)
 		}
-		defer bp.Close()
+	}
+	if retryAfter := d.retryAfter(); retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
 
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		if _, err := io.Copy(w, bp); err != nil {
+	contentType, page, ok, err := renderBlockPage(r, d, info)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if ok {
+		w.Header().Set("Content-Type", contentType)
+		if d.Path.BlockStatus != 0 {
+			w.WriteHeader(d.Path.BlockStatus)
+		}
+		if _, err := w.Write(page); err != nil {
 			return http.StatusInternalServerError, err
 		}
+		if d.Path.BlockStatus >= 400 {
+			// The response is written, don't let Caddy write an error.
+			return 0, nil
+		}
 		// we wrote the blockpage, return OK.
 		return http.StatusOK, nil
 	}
 
+	if d.Path.BlockStatus != 0 {
+		return d.Path.BlockStatus, nil
+	}
 	// if we don't have blockpage, return forbidden.
 	return http.StatusForbidden, nil
 }
@@ -100,6 +157,39 @@ func Setup(c *caddy.Controller) error {
 			Config: ifconfig,
 		}
 	}
+	// Keep the indexed prefix dirs and the hostnames in sync while the
+	// server is running.
+	for _, path := range ifconfig.Paths {
+		if path.prefixIndex != nil {
+			c.OnStartup(path.prefixIndex.Start)
+			c.OnShutdown(path.prefixIndex.Stop)
+		}
+		if path.Hosts != nil {
+			c.OnStartup(path.Hosts.Start)
+			c.OnShutdown(path.Hosts.Stop)
+		}
+	}
+
+	// Save the ban lists while the server is running.
+	if ifconfig.State != nil {
+		c.OnStartup(ifconfig.State.Start)
+		c.OnShutdown(ifconfig.State.Stop)
+	}
+
+	// Swap in the lists of this configuration when it starts, even if it
+	// defines none, so the ones it dropped are forgotten.
+	getIPListDefs(c)
+
+	// Don't keep the results of this configuration across a reload.
+	if ifconfig.Cache != nil {
+		c.OnShutdown(ifconfig.Cache.Purge)
+	}
+
+	// Open the decision log.
+	if ifconfig.DecisionLog != nil && ifconfig.DecisionLog.logger != nil {
+		ifconfig.DecisionLog.logger.Attach(c)
+	}
+
 	// Add middleware
 	cfg := httpserver.GetConfig(c)
 	cfg.AddMiddleware(newMiddleWare)
@@ -132,44 +222,141 @@ func getClientIP(r *http.Request, strict bool) (net.IP, error) {
 	return parsedIP, nil
 }
 
+// clientIPSource names where getClientIP takes the client's IP from.
+func clientIPSource(r *http.Request, strict bool) string {
+	if r.Header.Get("X-Forwarded-For") != "" && !strict {
+		return "X-Forwarded-For"
+	}
+	return "RemoteAddr"
+}
+
+// getSiteClientIP returns the client's IP as the site wide features, such as
+// the honeypot and autoban, see it: the remote address, unless it's one of
+// the trusted proxies. X-Forwarded-For is then walked from the right, and the
+// first address which isn't a trusted proxy is the client's. It also returns
+// where the IP was taken from.
+func getSiteClientIP(r *http.Request, trusted []*net.IPNet) (net.IP, string, error) {
+	ip, err := getClientIP(r, true)
+	if err != nil || !matchNets(trusted, ip) {
+		return ip, "RemoteAddr", err
+	}
+
+	source := "RemoteAddr"
+	fwdFor := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(fwdFor) - 1; i >= 0; i-- {
+		entry := strings.TrimSpace(fwdFor[i])
+		if entry == "" {
+			continue
+		}
+		hop := net.ParseIP(entry)
+		if hop == nil {
+			// Whatever is left of a malformed entry can't be trusted.
+			break
+		}
+		ip, source = hop, "X-Forwarded-For"
+		if !matchNets(trusted, hop) {
+			break
+		}
+	}
+	return ip, source, nil
+}
+
+// matchNets reports whether ip is in one of nets.
+func matchNets(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// What to do when a block can't evaluate a request.
+const (
+	onErrorAllow = "allow"
+	onErrorBlock = "block"
+	onErrorFail  = "error"
+)
+
 // ShouldAllow takes a path and a request and decides if it should be allowed
 func (ipf IPFilter) ShouldAllow(path IPPath, r *http.Request) (bool, string, error) {
-	allow := true
-	scopeMatched := ""
+	d, err := ipf.evaluate(path, ipf.newRequestState(r))
+	return d.Allow, d.Scope, err
+}
+
+// evaluate is ShouldAllow, also telling what the decision is based on. What
+// it resolves about the client is kept in s for the other blocks.
+func (ipf IPFilter) evaluate(path IPPath, s *requestState) (Decision, error) {
+	r := s.r
+	d := Decision{Allow: true, Path: path}
 
 	// check if we are in one of our scopes.
 	for _, scope := range path.PathScopes {
 		if httpserver.Path(r.URL.Path).Matches(scope) {
+			d.Scope = scope
+			d.Source = clientIPSource(r, path.Strict)
+			src := blockSource(path.Strict)
+
+			// a valid bypass token lets the request through.
+			if s.bypassed() {
+				d.Reason = "bypass"
+				return d, nil
+			}
+
 			// extract the client's IP and parse it.
-			clientIP, err := getClientIP(r, path.Strict)
+			clientIP, err := s.clientIP(src)
 			if err != nil {
-				return false, scope, err
+				d.Allow = false
+				return d, err
 			}
+			d.ClientIP = clientIP
 
 			// request status.
 			var rs Status
 
 			if len(path.CountryCodes) != 0 {
-				// do the lookup.
-				var result OnlyCountry
-				if err = ipf.Config.DBHandler.Lookup(clientIP, &result); err != nil {
-					return false, scope, err
+				// do the lookup, once per request.
+				clientCountry, err := s.country(src)
+				if err != nil {
+					d.Allow = false
+					return d, err
 				}
-
-				// get only the ISOCode out of the lookup results.
-				clientCountry := result.Country.ISOCode
+				d.Country = clientCountry
 				for _, c := range path.CountryCodes {
 					if clientCountry == c {
 						rs.countryMatch = true
+						d.Reason, d.Entry = "country", c
 						break
 					}
 				}
 			}
 
-			if len(path.Nets) != 0 {
-				for _, rng := range path.Nets {
-					if rng.Contains(clientIP) {
-						rs.inRange = true
+			if rng, ok := path.matchNet(clientIP); ok {
+				rs.inRange = true
+				d.Reason, d.Entry = "ip", rng.String()
+			}
+
+			if hn, ok := path.Hosts.Match(clientIP); ok {
+				rs.inRange = true
+				d.Reason, d.Entry = "host", hn.Host+" "+hn.Net.IP.String()
+			}
+
+			for _, l := range path.Lists {
+				if rng, ok := l.MatchIP(clientIP); ok {
+					rs.inRange = true
+					d.Reason, d.Entry = "list", l.Name+" "+rng.String()
+					break
+				}
+				if l.HasCountries() {
+					clientCountry, err := s.country(src)
+					if err != nil {
+						d.Allow = false
+						return d, err
+					}
+					d.Country = clientCountry
+					if l.MatchCountry(clientCountry) {
+						rs.countryMatch = true
+						d.Reason, d.Entry = "list", l.Name+" "+clientCountry
 						break
 					}
 				}
@@ -177,15 +364,38 @@ func (ipf IPFilter) ShouldAllow(path IPPath, r *http.Request) (bool, string, err
 
 			if ipf.PrefixDirBlocked(clientIP, path) {
 				rs.inRange = true
+				d.Reason, d.Entry = "prefix_dir", path.PrefixDir
+			}
+
+			if path.Bans != nil {
+				if b, banned := path.Bans.Match(clientIP); banned {
+					rs.inRange = true
+					d.Reason, d.Entry = "bans", path.Bans.Name+" "+b.Net.String()
+					d.Expires = b.Expires
+				}
+			}
+
+			// Only look crawlers up when nothing else matched and the
+			// client claims to be one, it takes DNS queries the first
+			// time a client is seen.
+			if len(path.VerifiedBots) != 0 && !rs.Any() && claimsCrawler(r.UserAgent()) {
+				names, err := s.botNames(src)
+				if err != nil {
+					d.Allow = false
+					return d, err
+				}
+				if name, ok := matchBotDomain(names, path.VerifiedBots); ok {
+					rs.inRange = true
+					d.Reason, d.Entry = "verified_bot", name
+				}
 			}
 
-			scopeMatched = scope
 			if rs.Any() {
 				// Rule matched, if the rule has IsBlock = true then we have to deny access
-				allow = !path.IsBlock
+				d.Allow = !path.IsBlock
 			} else {
 				// Rule did not match, if the rule has IsBlock = true then we have to allow access
-				allow = path.IsBlock
+				d.Allow = path.IsBlock
 			}
 
 			// We only have to test the first path that matches because it is the most specific
@@ -194,7 +404,20 @@ func (ipf IPFilter) ShouldAllow(path IPPath, r *http.Request) (bool, string, err
 	}
 
 	// no scope match, pass-through.
-	return allow, scopeMatched, nil
+	return d, nil
+}
+
+// matchNet returns the range of Nets containing ip, if any.
+func (path IPPath) matchNet(ip net.IP) (*net.IPNet, bool) {
+	if path.netIndex != nil {
+		return path.netIndex.Match(ip)
+	}
+	for _, rng := range path.Nets {
+		if rng.Contains(ip) {
+			return rng, true
+		}
+	}
+	return nil, false
 }
 
 // PrefixDirBlocked takes an IP and a path and decides to allow or block based on prefix_dir.
@@ -203,78 +426,258 @@ func (ipf IPFilter) PrefixDirBlocked(clientIP net.IP, path IPPath) bool {
 		return false
 	}
 
-	fname := clientIP.String()
+	if path.prefixIndex != nil {
+		return path.prefixIndex.Has(clientIP)
+	}
+
+	// Not cached: a file dropped in the directory has to take effect
+	// right away. Use prefix_dir_index to avoid the lookups.
+	for _, name := range prefixDirNames(clientIP) {
+		if _, err := os.Stat(filepath.Join(path.PrefixDir, filepath.FromSlash(name))); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixDirNames returns the file names, relative to a prefix_dir, under
+// which clientIP may be listed.
+func prefixDirNames(clientIP net.IP) []string {
+	fname := canonicalIP(clientIP)
 	fname_variant := ""
 	is_ipv6 := clientIP.To4() == nil
 	if is_ipv6 {
 		fname_variant = strings.ReplaceAll(fname, ":", "=")
 	}
 
-	// Check the "flat" namespace.
-	blacklistPath := filepath.Join(path.PrefixDir, fname)
-	if _, err := os.Stat(blacklistPath); err == nil {
-		return true
-	}
+	// The "flat" namespace.
+	names := []string{fname}
 	if is_ipv6 {
-		blacklistPath := filepath.Join(path.PrefixDir, fname_variant)
-		if _, err := os.Stat(blacklistPath); err == nil {
-			return true
-		}
+		names = append(names, fname_variant)
 	}
 
-	// Check the "sharded" namespace.
+	// The "sharded" namespace.
 	c := strings.SplitN(fname, ".", 3) // shard IPv4 address
 	if len(c) != 3 {
 		c = strings.SplitN(fname, ":", 3) // shard IPv6 address
 		if len(c) != 3 {
 			// This should be a "can't happen" situation. Perhaps there is an
 			// IP address type we don't know how to shard. But rather than
-			// blow up below just log the problem and grant access.
+			// blow up below just log the problem and only check the flat
+			// namespace.
 			log.Println("ipfilter: Could not shard address:", fname)
-			return false
+			return names
 		}
 	}
-	blacklistPath = filepath.Join(path.PrefixDir, c[0], c[1], fname)
-	if _, err := os.Stat(blacklistPath); err == nil {
-		return true
-	}
+	names = append(names, c[0]+"/"+c[1]+"/"+fname)
 	if is_ipv6 {
-		blacklistPath = filepath.Join(path.PrefixDir, c[0], c[1], fname_variant)
-		if _, err := os.Stat(blacklistPath); err == nil {
-			return true
-		}
+		names = append(names, c[0]+"/"+c[1]+"/"+fname_variant)
 	}
 
-	return false
+	return names
 }
 
 func (ipf IPFilter) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
-	allow := true
-	matchedPath := ""
-	blockPage := ""
+	if admin := ipf.Config.Admin; admin != nil && matchesEndpoint(r.URL.Path, admin.Path) {
+		return ipf.serveAdmin(w, r)
+	}
+
+	if metrics := ipf.Config.Metrics; metrics != nil && matchesEndpoint(r.URL.Path, metrics.Path) {
+		return ipf.serveMetrics(w, r)
+	}
+
+	start := time.Now()
+	s := ipf.newRequestState(r)
+
+	if honeypot := ipf.Config.Honeypot; honeypot != nil && honeypot.Matches(r) {
+		if client := s.client(sourceSite); client.err == nil {
+			honeypot.Trap(client.ip, r.URL.Path)
+			d := Decision{
+				Index:    -1,
+				ClientIP: client.ip,
+				Source:   client.source,
+				Reason:   "honeypot",
+				Entry:    r.URL.Path,
+			}
+			d.RequestID = s.requestID()
+			ipf.record(r, start, d)
+			info := ipf.clientInfo(s)
+			ipf.setPlaceholders(r, d, info)
+			return ipf.act(w, r, d, info)
+		}
+	}
+
+	d, err := ipf.decide(s)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	info := ipf.clientInfo(s)
+	if !d.Allow && redirectsToItself(r, d, info) {
+		// Let the client see the page it's redirected to, rather than loop.
+		d.Allow = true
+	}
+	if !d.Allow || ipf.Config.DecisionLog != nil {
+		d.RequestID = s.requestID()
+	}
+	ipf.record(r, start, d)
+	ipf.setPlaceholders(r, d, info)
+
+	// The blocks in report mode only tell what they would have done.
+	if report, err := ipf.reportDecision(s); err != nil {
+		log.Printf("ipfilter: [report] Can't evaluate block %s: %v", blockName(report.Path, report.Index), err)
+	} else if report.Scope != "" {
+		if !report.Allow {
+			log.Printf("ipfilter: [report] would block %s on %s", report.ClientIP, report.Scope)
+		}
+		if report.Path.ReportHeader != "" {
+			w.Header().Set(report.Path.ReportHeader, decisionString(report.Allow))
+		}
+		if ipf.Config.DecisionLog != nil {
+			report.RequestID = s.requestID()
+		}
+		ipf.Config.Metrics.Report(report)
+		ipf.Config.DecisionLog.Log(r, report)
+	}
+
+	if !d.Allow {
+		return ipf.act(w, r, d, info)
+	}
+
+	ipf.enrich(r, info)
+
+	autoban := ipf.Config.Autoban
+	if autoban == nil {
+		return ipf.Next.ServeHTTP(w, r)
+	}
+	clientIP, err := s.clientIP(sourceSite)
+	if err != nil {
+		// Nothing to track.
+		return ipf.Next.ServeHTTP(w, r)
+	}
+	autoban.Request(clientIP, r)
+	rec := httpserver.NewResponseRecorder(w)
+	status, err := ipf.Next.ServeHTTP(rec, r)
+	if status < 400 {
+		// The response was written, or will be, with the recorded status.
+		autoban.Response(clientIP, rec.Status())
+	} else {
+		autoban.Response(clientIP, status)
+	}
+	return status, err
+}
+
+// record logs and counts the decision d, whose evaluation started at start.
+func (ipf IPFilter) record(r *http.Request, start time.Time, d Decision) {
+	ipf.Config.Metrics.Observe(d, time.Since(start))
+	ipf.Config.DecisionLog.Log(r, d)
+}
+
+// Decision is the outcome of running a request through the ipfilter blocks.
+type Decision struct {
+	Allow    bool
+	Path     IPPath // The block which decided, the zero value if none did.
+	Index    int    // The index of that block, -1 if none did.
+	Scope    string // The path scope of the block which matched the request.
+	ClientIP net.IP
+	Source   string    // Where the client's IP was taken from.
+	Country  string    // The client's country, if it was looked up.
+	Reason   string    // What matched: "ip", "country", "prefix_dir", "bans"...
+	Entry    string    // The entry which matched, e.g. the CIDR range.
+	Expires  time.Time // When the ban which matched expires, if it does.
+
+	// The ID of the request, as shown on the block page and logged. Only
+	// set when the request is blocked or decisions are logged.
+	RequestID string
+}
+
+// retryAfter returns how long the client should wait before retrying, or
+// zero if it's not known.
+func (d Decision) retryAfter() time.Duration {
+	if !d.Expires.IsZero() {
+		return time.Until(d.Expires)
+	}
+	return d.Path.RetryAfter
+}
+
+// decisionString returns the name of the rule applied by a decision.
+func decisionString(allow bool) string {
+	if allow {
+		return "allow"
+	}
+	return "block"
+}
+
+// decide runs the request of s through the IPPaths and returns the decision.
+// The blocks in report mode have no say in it, see reportDecision.
+func (ipf IPFilter) decide(s *requestState) (Decision, error) {
+	d := Decision{Allow: true, Index: -1}
+
+	// Clients in the enforced ban lists are blocked whatever the rules.
+	if len(ipf.Config.Enforced) != 0 {
+		if client := s.client(sourceSite); client.err == nil {
+			for _, bans := range ipf.Config.Enforced {
+				if b, banned := bans.Match(client.ip); banned {
+					d.Allow = false
+					d.ClientIP = client.ip
+					d.Source = client.source
+					d.Reason, d.Entry = "bans", bans.Name+" "+b.Net.String()
+					d.Expires = b.Expires
+					return d, nil
+				}
+			}
+		}
+	}
+
+	return ipf.decideAmong(s, false)
+}
+
+// reportDecision returns what the blocks in report mode would have decided
+// for the request of s. Its Scope is empty if none of them matched.
+func (ipf IPFilter) reportDecision(s *requestState) (Decision, error) {
+	return ipf.decideAmong(s, true)
+}
+
+// decideAmong runs the request of s through the IPPaths in report mode, or
+// through the others, and returns the decision of the one with the longest
+// matching scope.
+func (ipf IPFilter) decideAmong(s *requestState, reportOnly bool) (Decision, error) {
+	r := s.r
+	d := Decision{Allow: true, Index: -1}
 
 	// Loop over all IPPaths in the config
-	for _, path := range ipf.Config.Paths {
-		pathAllow, pathMathedPath, err := ipf.ShouldAllow(path, r)
+	for i, path := range ipf.Config.Paths {
+		if path.ReportOnly != reportOnly {
+			continue
+		}
+		pathDecision, err := ipf.evaluate(path, s)
 		if err != nil {
-			return http.StatusInternalServerError, err
+			pathDecision.Index = i
+			if path.OnError == "" || path.OnError == onErrorFail {
+				return pathDecision, err
+			}
+			log.Printf("ipfilter: Can't evaluate block %s for %s %s (remote %s, X-Forwarded-For %q), %sing: %v",
+				blockName(path, i), r.Method, r.URL.RequestURI(), r.RemoteAddr,
+				r.Header.Get("X-Forwarded-For"), path.OnError, err)
+			pathDecision.Allow = path.OnError == onErrorAllow
+			pathDecision.Reason, pathDecision.Entry = "error", ""
 		}
 
-		if len(pathMathedPath) >= len(matchedPath) {
-			allow = pathAllow
-			matchedPath = pathMathedPath
-			blockPage = path.BlockPage
+		if len(pathDecision.Scope) >= len(d.Scope) {
+			d = pathDecision
+			d.Index = i
 		}
 	}
 
-	if !allow {
-		return block(blockPage, w)
-	}
-	return ipf.Next.ServeHTTP(w, r)
+	return d, nil
 }
 
 // parseIP parses a string to an IP range.
 func parseIP(ip string) ([]*net.IPNet, error) {
+	// Keywords for the special-purpose ranges, e.g. "private".
+	if nets, ok := keywordNets(ip); ok {
+		return nets, nil
+	}
+
 	// CIDR notation
 	_, ipnet, err := net.ParseCIDR(ip)
 	if err == nil {
@@ -293,6 +696,29 @@ func parseIP(ip string) ([]*net.IPNet, error) {
 
 	// for backward compatibility, convert ranges into CIDR notation.
 	parseError := fmt.Errorf("Can't parse IP: %s", ip)
+
+	// a range of ips, e.g. 1.1.1.1-10, 10.0.0.5-10.0.3.200 or
+	// 2001:db8::1-2001:db8::ff
+	if strings.Contains(ip, "-") {
+		start, end := parseRange(ip)
+		if start == nil {
+			return nil, parseError
+		}
+		if net.ParseIP(strings.SplitN(ip, "-", 2)[1]) == nil {
+			warnLegacyRange(ip)
+		}
+		return range2CIDRs(start, end), nil
+	}
+
+	// octet wildcards, e.g. 192.168.*.0
+	if strings.Contains(ip, "*") {
+		nets, err := parseWildcard(ip)
+		if err != nil {
+			return nil, fmt.Errorf("Can't parse IP: %s: %v", ip, err)
+		}
+		return nets, nil
+	}
+
 	// check if the ip isn't complete;
 	// e.g. 192.168 -> Range{"192.168.0.0", "192.168.255.255"}
 	dotSplit := strings.Split(ip, ".")
@@ -309,28 +735,7 @@ func parseIP(ip string) ([]*net.IPNet, error) {
 			return nil, parseError
 		}
 
-		return range2CIDRs(start, end), nil
-	}
-
-	// try to split on '-' to see if it is a range of ips e.g. 1.1.1.1-10
-	splitted := strings.Split(ip, "-")
-	if len(splitted) > 1 { // if more than one, then we got a range e.g. ["1.1.1.1", "10"]
-		start := net.ParseIP(splitted[0])
-		// make sure that we got a valid IPv4 IP.
-		if start.To4() == nil {
-			return nil, parseError
-		}
-
-		// split the start of the range on "." and switch the last field with splitted[1], e.g 1.1.1.1 -> 1.1.1.10
-		fields := strings.Split(start.String(), ".")
-		fields[3] = splitted[1]
-		end := net.ParseIP(strings.Join(fields, "."))
-
-		// parse the end range.
-		if end.To4() == nil {
-			return nil, parseError
-		}
-
+		warnLegacyRange(ip)
 		return range2CIDRs(start, end), nil
 	}
 
@@ -342,6 +747,8 @@ func parseIP(ip string) ([]*net.IPNet, error) {
 func ipfilterParseSingle(config *IPFConfig, c *caddy.Controller) (IPPath, error) {
 	var cPath IPPath
 	ruleTypeSpecified := false
+	var indexInterval, hostTTL time.Duration
+	var checkPrefixDir bool
 
 	// Get PathScopes
 	cPath.PathScopes = c.RemainingArgs()
@@ -355,6 +762,19 @@ func ipfilterParseSingle(config *IPFConfig, c *caddy.Controller) (IPPath, error)
 	for c.NextBlock() {
 		value := c.Val()
 
+		if httpserver.IsLogRollerSubdirective(value) {
+			if config.DecisionLog == nil || config.DecisionLog.logger == nil {
+				return cPath, c.Err("ipfilter: " + value + " requires a 'log' file")
+			}
+			if config.DecisionLog.logger.Roller == nil {
+				config.DecisionLog.logger.Roller = httpserver.DefaultLogRoller()
+			}
+			if err := httpserver.ParseRoller(config.DecisionLog.logger.Roller, value, c.RemainingArgs()...); err != nil {
+				return cPath, c.Err("ipfilter: " + err.Error())
+			}
+			continue
+		}
+
 		switch value {
 		case "rule":
 			if !c.NextArg() {
@@ -388,17 +808,132 @@ func ipfilterParseSingle(config *IPFConfig, c *caddy.Controller) (IPPath, error)
 			if err != nil {
 				return cPath, c.Err("ipfilter: Can't open database: " + database)
 			}
-		case "blockpage":
+		case "asn_database":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			if config.ASNHandler != nil {
+				return cPath, c.Err("ipfilter: An ASN database is already opened")
+			}
+
+			database := c.Val()
+			var err error
+			config.ASNHandler, err = maxminddb.Open(database)
+			if err != nil {
+				return cPath, c.Err("ipfilter: Can't open database: " + database)
+			}
+		case "blockpage", "blockpage_json", "blockpage_text":
 			if !c.NextArg() {
 				return cPath, c.ArgErr()
 			}
 
-			// check if blockpage exists.
+			// check if blockpage exists and is a valid template.
 			blockpage := c.Val()
 			if _, err := os.Stat(blockpage); os.IsNotExist(err) {
 				return cPath, c.Err("ipfilter: No such file: " + blockpage)
 			}
-			cPath.BlockPage = blockpage
+			media := map[string]string{
+				"blockpage":      mediaHTML,
+				"blockpage_json": mediaJSON,
+				"blockpage_text": mediaText,
+			}[value]
+			if _, err := loadPage(media, blockpage); err != nil {
+				return cPath, c.Err("ipfilter: Invalid blockpage: " + err.Error())
+			}
+			switch media {
+			case mediaHTML:
+				cPath.BlockPage = blockpage
+			case mediaJSON:
+				cPath.BlockPageJSON = blockpage
+			case mediaText:
+				cPath.BlockPageText = blockpage
+			}
+		case "action":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return cPath, c.ArgErr()
+			}
+			switch args[0] {
+			case actionBlock:
+				if len(args) != 1 {
+					return cPath, c.ArgErr()
+				}
+			case actionRedirect:
+				if len(args) < 2 || len(args) > 3 {
+					return cPath, c.ArgErr()
+				}
+				cPath.RedirectURL = args[1]
+				cPath.RedirectCode = http.StatusFound
+				if len(args) == 3 {
+					code, err := strconv.Atoi(args[2])
+					if err != nil || code < 300 || code > 399 {
+						return cPath, c.Err("ipfilter: Invalid redirect code: " + args[2])
+					}
+					cPath.RedirectCode = code
+				}
+			case actionDrop:
+				if len(args) != 1 {
+					return cPath, c.ArgErr()
+				}
+			case actionTarpit:
+				if len(args) != 2 {
+					return cPath, c.ArgErr()
+				}
+				delay, err := time.ParseDuration(args[1])
+				if err != nil || delay <= 0 {
+					return cPath, c.Err("ipfilter: Invalid tarpit delay: " + args[1])
+				}
+				cPath.TarpitDelay = delay
+				if config.Tarpit == nil {
+					config.Tarpit = newTarpit(defaultTarpitMax)
+				}
+			default:
+				return cPath, c.Err("ipfilter: Unknown action: " + args[0])
+			}
+			cPath.Action = args[0]
+		case "tarpit_max":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			max, err := strconv.Atoi(c.Val())
+			if err != nil || max <= 0 {
+				return cPath, c.Err("ipfilter: Invalid tarpit_max: " + c.Val())
+			}
+			config.Tarpit = newTarpit(max)
+		case "status":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			status, err := strconv.Atoi(c.Val())
+			if err != nil || status < 200 || status > 599 {
+				return cPath, c.Err("ipfilter: Invalid status: " + c.Val())
+			}
+			cPath.BlockStatus = status
+		case "header":
+			args := c.RemainingArgs()
+			if len(args) != 2 {
+				return cPath, c.ArgErr()
+			}
+			if cPath.BlockHeaders == nil {
+				cPath.BlockHeaders = make(http.Header)
+			}
+			cPath.BlockHeaders.Add(args[0], args[1])
+		case "retry_after":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			retryAfter, err := time.ParseDuration(c.Val())
+			if err != nil {
+				seconds, serr := strconv.Atoi(c.Val())
+				if serr != nil {
+					return cPath, c.Err("ipfilter: Invalid retry_after: " + c.Val())
+				}
+				retryAfter = time.Duration(seconds) * time.Second
+			}
+			if retryAfter <= 0 {
+				return cPath, c.Err("ipfilter: Invalid retry_after: " + c.Val())
+			}
+			cPath.RetryAfter = retryAfter
 		case "country":
 			countryCodes := c.RemainingArgs()
 			if len(countryCodes) == 0 {
@@ -412,6 +947,18 @@ func ipfilterParseSingle(config *IPFConfig, c *caddy.Controller) (IPPath, error)
 			}
 
 			for _, ip := range ips {
+				if strings.HasPrefix(ip, hostPrefix) {
+					host := strings.TrimPrefix(ip, hostPrefix)
+					if host == "" {
+						return cPath, c.Err("ipfilter: Missing hostname: " + ip)
+					}
+					if cPath.Hosts == nil {
+						cPath.Hosts = newHostSet()
+					}
+					cPath.Hosts.Names = append(cPath.Hosts.Names, host)
+					continue
+				}
+
 				ipRange, err := parseIP(ip)
 				if err != nil {
 					return cPath, c.Err("ipfilter: " + err.Error())
@@ -419,6 +966,97 @@ func ipfilterParseSingle(config *IPFConfig, c *caddy.Controller) (IPPath, error)
 
 				cPath.Nets = append(cPath.Nets, ipRange...)
 			}
+		case "verified_bot":
+			domains := c.RemainingArgs()
+			if len(domains) == 0 {
+				return cPath, c.ArgErr()
+			}
+			for _, arg := range domains {
+				domain := strings.ToLower(strings.Trim(arg, "."))
+				if domain == "" {
+					return cPath, c.Err("ipfilter: Invalid verified_bot domain: " + arg)
+				}
+				cPath.VerifiedBots = append(cPath.VerifiedBots, domain)
+			}
+			if config.Bots == nil {
+				config.Bots = newBotVerifier()
+			}
+		case "host_ttl":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			d, err := time.ParseDuration(c.Val())
+			if err != nil || d <= 0 {
+				return cPath, c.Err("ipfilter: Invalid host_ttl: " + c.Val())
+			}
+			hostTTL = d
+		case "resolver":
+			if !c.NextArg() || config.Resolver != nil {
+				return cPath, c.ArgErr()
+			}
+			addr := c.Val()
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				addr = net.JoinHostPort(addr, "53")
+			}
+			config.Resolver = newResolver(addr)
+		case "trusted_proxies":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return cPath, c.ArgErr()
+			}
+			for _, arg := range args {
+				ipRanges, err := parseIP(arg)
+				if err != nil {
+					return cPath, c.Err("ipfilter: " + err.Error())
+				}
+				config.TrustedProxies = append(config.TrustedProxies, ipRanges...)
+			}
+		case "ip_file":
+			files := c.RemainingArgs()
+			if len(files) == 0 {
+				return cPath, c.ArgErr()
+			}
+			for _, file := range files {
+				ipRanges, err := parseIPFile(file)
+				if err != nil {
+					return cPath, c.Err("ipfilter: " + err.Error())
+				}
+				cPath.Nets = append(cPath.Nets, ipRanges...)
+			}
+		case "cloud":
+			args := c.RemainingArgs()
+			if len(args) < 2 {
+				return cPath, c.ArgErr()
+			}
+			filter, err := parseCloudFilters(args[2:])
+			if err != nil {
+				return cPath, c.Err("ipfilter: " + err.Error())
+			}
+			ipRanges, err := loadCloudRanges(args[0], args[1], filter)
+			if err != nil {
+				return cPath, c.Err("ipfilter: " + err.Error())
+			}
+			cPath.Nets = append(cPath.Nets, ipRanges...)
+		case "list":
+			names := c.RemainingArgs()
+			if len(names) == 0 {
+				return cPath, c.ArgErr()
+			}
+			// Checked once every lists file of the site is loaded.
+			for _, name := range names {
+				cPath.Lists = append(cPath.Lists, GetIPList(name))
+			}
+		case "lists":
+			files := c.RemainingArgs()
+			if len(files) == 0 {
+				return cPath, c.ArgErr()
+			}
+			for _, file := range files {
+				if _, err := getIPListDefs(c).load(file); err != nil {
+					return cPath, c.Err("ipfilter: Can't load lists: " + err.Error())
+				}
+				config.ListFiles = append(config.ListFiles, file)
+			}
 		case "strict":
 			if c.NextArg() {
 				return cPath, c.ArgErr()
@@ -434,11 +1072,320 @@ func ipfilterParseSingle(config *IPFConfig, c *caddy.Controller) (IPPath, error)
 				return cPath, c.Err("ipfilter: No such blacklist prefix dir: " + prefixDir)
 			}
 			cPath.PrefixDir = prefixDir
+		case "bans":
+			args := c.RemainingArgs()
+			if len(args) > 1 || cPath.Bans != nil {
+				return cPath, c.ArgErr()
+			}
+			name := DefaultBanList
+			if len(args) == 1 {
+				name = args[0]
+			}
+			cPath.Bans = GetBanList(name)
+		case "admin":
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return cPath, c.ArgErr()
+			}
+			if config.Admin != nil {
+				return cPath, c.Err("ipfilter: Only one 'admin' directive allowed")
+			}
+			config.Admin = &Admin{Path: args[0], Bans: GetBanList(DefaultBanList)}
+			if len(args) == 2 {
+				config.Admin.Bans = GetBanList(args[1])
+			}
+		case "admin_token":
+			if !c.NextArg() || config.Admin == nil {
+				return cPath, c.ArgErr()
+			}
+			config.Admin.Token = c.Val()
+		case "admin_allow":
+			ips := c.RemainingArgs()
+			if len(ips) == 0 || config.Admin == nil {
+				return cPath, c.ArgErr()
+			}
+			for _, ip := range ips {
+				ipRange, err := parseIP(ip)
+				if err != nil {
+					return cPath, c.Err("ipfilter: " + err.Error())
+				}
+				config.Admin.Allow = append(config.Admin.Allow, ipRange...)
+			}
+		case "admin_persist":
+			if !c.NextArg() || config.Admin == nil {
+				return cPath, c.ArgErr()
+			}
+			dir := c.Val()
+			if statb, err := os.Stat(dir); os.IsNotExist(err) || !statb.IsDir() {
+				return cPath, c.Err("ipfilter: No such admin persist dir: " + dir)
+			}
+			if err := config.Admin.Bans.LoadDir(dir); err != nil {
+				return cPath, c.Err("ipfilter: Can't load admin persist dir: " + err.Error())
+			}
+			config.Admin.PersistDir = dir
+		case "autoban":
+			args := c.RemainingArgs()
+			rule, err := parseAutobanRule(args)
+			if err != nil {
+				return cPath, c.Err("ipfilter: " + err.Error())
+			}
+			if config.Autoban == nil {
+				config.Autoban = newAutoban()
+			}
+			config.Autoban.Rules = append(config.Autoban.Rules, rule)
+		case "autoban_ttl":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			if config.Autoban == nil {
+				config.Autoban = newAutoban()
+			}
+			ttl, err := time.ParseDuration(c.Val())
+			if err != nil || ttl <= 0 {
+				return cPath, c.Err("ipfilter: Invalid autoban_ttl: " + c.Val())
+			}
+			config.Autoban.TTL = ttl
+		case "autoban_list":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			if config.Autoban == nil {
+				config.Autoban = newAutoban()
+			}
+			config.Autoban.Bans = GetBanList(c.Val())
+		case "autoban_ipv6_prefix":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			if config.Autoban == nil {
+				config.Autoban = newAutoban()
+			}
+			bits, err := strconv.Atoi(c.Val())
+			if err != nil || bits <= 0 || bits > 128 {
+				return cPath, c.Err("ipfilter: Invalid autoban_ipv6_prefix: " + c.Val())
+			}
+			config.Autoban.IPv6Prefix = bits
+		case "honeypot":
+			paths := c.RemainingArgs()
+			if len(paths) == 0 {
+				return cPath, c.ArgErr()
+			}
+			if config.Honeypot == nil {
+				config.Honeypot = newHoneypot()
+			}
+			config.Honeypot.Paths = append(config.Honeypot.Paths, paths...)
+		case "honeypot_ttl":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			ttl, err := time.ParseDuration(c.Val())
+			if err != nil || ttl <= 0 {
+				return cPath, c.Err("ipfilter: Invalid honeypot_ttl: " + c.Val())
+			}
+			if config.Honeypot == nil {
+				config.Honeypot = newHoneypot()
+			}
+			config.Honeypot.TTL = ttl
+		case "honeypot_list":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			if config.Honeypot == nil {
+				config.Honeypot = newHoneypot()
+			}
+			config.Honeypot.Bans = GetBanList(c.Val())
+		case "cache":
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 || config.Cache != nil {
+				return cPath, c.ArgErr()
+			}
+			size, err := strconv.Atoi(args[0])
+			if err != nil || size <= 0 {
+				return cPath, c.Err("ipfilter: Invalid cache size: " + args[0])
+			}
+			var ttl time.Duration
+			if len(args) == 2 {
+				if ttl, err = time.ParseDuration(args[1]); err != nil || ttl <= 0 {
+					return cPath, c.Err("ipfilter: Invalid cache ttl: " + args[1])
+				}
+			}
+			config.Cache = newCache(size, ttl)
+		case "state_file":
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 || config.State != nil {
+				return cPath, c.ArgErr()
+			}
+			var interval time.Duration
+			if len(args) == 2 {
+				d, err := time.ParseDuration(args[1])
+				if err != nil || d <= 0 {
+					return cPath, c.Err("ipfilter: Invalid state_file interval: " + args[1])
+				}
+				interval = d
+			}
+			config.State = newState(args[0], interval)
+		case "mode":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			switch c.Val() {
+			case "enforce":
+				cPath.ReportOnly = false
+			case "report":
+				cPath.ReportOnly = true
+			default:
+				return cPath, c.Err("ipfilter: Mode should be 'enforce' or 'report'")
+			}
+		case "on_error":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			switch c.Val() {
+			case onErrorAllow, onErrorBlock, onErrorFail:
+				cPath.OnError = c.Val()
+			default:
+				return cPath, c.Err("ipfilter: on_error should be 'allow', 'block' or 'error'")
+			}
+		case "report_header":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			cPath.ReportHeader = c.Val()
+		case "log":
+			args := c.RemainingArgs()
+			if len(args) != 1 || config.DecisionLog != nil {
+				return cPath, c.ArgErr()
+			}
+			config.DecisionLog = newDecisionLog(args[0])
+		case "log_sample":
+			if !c.NextArg() || config.DecisionLog == nil {
+				return cPath, c.ArgErr()
+			}
+			rate, err := strconv.ParseFloat(c.Val(), 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return cPath, c.Err("ipfilter: log_sample should be in (0, 1]: " + c.Val())
+			}
+			config.DecisionLog.Sample = rate
+		case "log_allowed":
+			if c.NextArg() || config.DecisionLog == nil {
+				return cPath, c.ArgErr()
+			}
+			config.DecisionLog.Allowed = true
+		case "name":
+			if !c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			cPath.Name = c.Val()
+		case "metrics":
+			args := c.RemainingArgs()
+			if len(args) == 0 || config.Metrics != nil {
+				return cPath, c.ArgErr()
+			}
+			// Like the admin endpoint, it must not be left open to everyone.
+			if len(args) == 1 {
+				return cPath, c.Err("ipfilter: The metrics endpoint requires the addresses allowed to read it")
+			}
+			config.Metrics = newMetrics(args[0])
+			for _, ip := range args[1:] {
+				ipRange, err := parseIP(ip)
+				if err != nil {
+					return cPath, c.Err("ipfilter: " + err.Error())
+				}
+				config.Metrics.Allow = append(config.Metrics.Allow, ipRange...)
+			}
+		case "enrich":
+			args := c.RemainingArgs()
+			if len(args) != 2 {
+				return cPath, c.ArgErr()
+			}
+			if !enrichFields[args[0]] {
+				return cPath, c.Err("ipfilter: Unknown enrich field: " + args[0])
+			}
+			config.Enrich = append(config.Enrich, Enrichment{Field: args[0], Header: args[1]})
+		case "bypass":
+			if !c.NextArg() || config.Bypass != nil {
+				return cPath, c.ArgErr()
+			}
+			if len(c.Val()) < minBypassSecret {
+				return cPath, c.Err("ipfilter: The bypass secret must be at least " + strconv.Itoa(minBypassSecret) + " bytes long")
+			}
+			config.Bypass = newBypass(c.Val())
+		case "bypass_cookie", "bypass_header":
+			if !c.NextArg() || config.Bypass == nil {
+				return cPath, c.ArgErr()
+			}
+			if value == "bypass_cookie" {
+				config.Bypass.Cookie = c.Val()
+			} else {
+				config.Bypass.Header = c.Val()
+			}
+		case "prefix_dir_check":
+			if c.NextArg() {
+				return cPath, c.ArgErr()
+			}
+			checkPrefixDir = true
+		case "prefix_dir_index":
+			// Load prefix_dir in memory, the optional argument is the
+			// rescan interval used if the dir can't be watched.
+			args := c.RemainingArgs()
+			if len(args) > 1 {
+				return cPath, c.ArgErr()
+			}
+			indexInterval = defaultPrefixPollInterval
+			if len(args) == 1 {
+				d, err := time.ParseDuration(args[0])
+				if err != nil || d <= 0 {
+					return cPath, c.Err("ipfilter: Invalid prefix_dir_index interval: " + args[0])
+				}
+				indexInterval = d
+			}
+		}
+	}
+
+	if indexInterval != 0 {
+		if cPath.PrefixDir == "" {
+			return cPath, c.Err("ipfilter: prefix_dir_index requires a prefix_dir")
+		}
+		idx, err := newPrefixIndex(cPath.PrefixDir, indexInterval)
+		if err != nil {
+			return cPath, c.Err("ipfilter: Can't index prefix dir: " + err.Error())
 		}
+		cPath.prefixIndex = idx
+	}
+
+	if checkPrefixDir {
+		if cPath.PrefixDir == "" {
+			return cPath, c.Err("ipfilter: prefix_dir_check requires a prefix_dir")
+		}
+		bad, err := UnmatchablePrefixEntries(cPath.PrefixDir, cPath.prefixIndex != nil)
+		if err != nil {
+			return cPath, c.Err("ipfilter: Can't check prefix dir: " + err.Error())
+		}
+		for _, entry := range bad {
+			log.Printf("ipfilter: %s/%s can never match a client", cPath.PrefixDir, entry)
+		}
+	}
+
+	// The same ranges may come from several sources, e.g. cloud. They are
+	// only merged in the index, Nets is kept as configured.
+	if len(cPath.Nets) != 0 {
+		cPath.netIndex = newNetIndex(cPath.Nets)
+	}
+
+	if hostTTL != 0 {
+		if cPath.Hosts == nil {
+			return cPath, c.Err("ipfilter: host_ttl requires a 'host:' entry")
+		}
+		cPath.Hosts.TTL = hostTTL
 	}
 
 	if !ruleTypeSpecified {
-		return cPath, c.Err("ipfilter: There must be one 'rule' directive per block")
+		// A block without anything to match only configures the site
+		// wide features, like enrich.
+		if len(cPath.Nets) != 0 || len(cPath.CountryCodes) != 0 || cPath.PrefixDir != "" || cPath.Bans != nil || len(cPath.Lists) != 0 || cPath.Hosts != nil || len(cPath.VerifiedBots) != 0 {
+			return cPath, c.Err("ipfilter: There must be one 'rule' directive per block")
+		}
+		cPath.ruleless = true
 	}
 	return cPath, nil
 }
@@ -447,7 +1394,7 @@ func ipfilterParseSingle(config *IPFConfig, c *caddy.Controller) (IPPath, error)
 func ipfilterParse(c *caddy.Controller) (IPFConfig, error) {
 	var config IPFConfig
 
-	var hasCountryCodes, hasRanges, hasPrefixDir bool
+	var hasCountryCodes, hasRanges, hasPrefixDir, hasBans, hasLists, hasListCountries bool
 
 	for c.Next() {
 		path, err := ipfilterParseSingle(&config, c)
@@ -455,32 +1402,137 @@ func ipfilterParse(c *caddy.Controller) (IPFConfig, error) {
 			return config, err
 		}
 
+		if path.ruleless {
+			continue
+		}
+
 		if len(path.CountryCodes) != 0 {
 			hasCountryCodes = true
 		}
-		if len(path.Nets) != 0 {
+		if len(path.Nets) != 0 || path.Hosts != nil || len(path.VerifiedBots) != 0 {
 			hasRanges = true
 		}
 		if path.PrefixDir != "" {
 			hasPrefixDir = true
 		}
+		if path.Bans != nil {
+			hasBans = true
+		}
+		if len(path.Lists) != 0 {
+			hasLists = true
+		}
 
 		config.Paths = append(config.Paths, path)
 	}
 
+	// The lists used by the site must be defined by the files it loads,
+	// which were parsed with its blocks.
+	defs := getIPListDefs(c)
+	defined := make(map[string]bool)
+	for _, file := range config.ListFiles {
+		names, _ := defs.load(file)
+		for _, name := range names {
+			defined[name] = true
+		}
+	}
+	for _, path := range config.Paths {
+		for _, l := range path.Lists {
+			if !defined[l.Name] {
+				return config, c.Err("ipfilter: List " + l.Name + " is not defined by the lists files of the site")
+			}
+			if len(defs.lists[l.Name].countries) != 0 {
+				hasListCountries = true
+			}
+		}
+	}
+
 	// having a database is mandatory if you are blocking by country codes.
-	if hasCountryCodes && config.DBHandler == nil {
+	if (hasCountryCodes || hasListCountries) && config.DBHandler == nil {
 		return config, c.Err("ipfilter: Database is required to block/allow by country")
 	}
 
+	// enrich passes upstream what the databases know, so they must be there.
+	for _, e := range config.Enrich {
+		switch {
+		case e.Field == "country" && config.DBHandler == nil:
+			return config, c.Err("ipfilter: Database is required to enrich with the country")
+		case (e.Field == "asn" || e.Field == "asn_org") && config.ASNHandler == nil:
+			return config, c.Err("ipfilter: ASN database is required to enrich with " + e.Field)
+		}
+	}
+
 	// Must specify at least one of these subdirectives.
-	if !hasCountryCodes && !hasRanges && !hasPrefixDir {
-		return config, c.Err("ipfilter: No IPs, Country codes, or prefix dir has been provided")
+	if !hasCountryCodes && !hasRanges && !hasPrefixDir && !hasBans && !hasLists && len(config.Enrich) == 0 {
+		return config, c.Err("ipfilter: No IPs, Country codes, prefix dir, bans or lists has been provided")
+	}
+
+	if config.Autoban != nil {
+		if len(config.Autoban.Rules) == 0 {
+			return config, c.Err("ipfilter: At least one 'autoban' rule is required")
+		}
+		config.Enforced = append(config.Enforced, config.Autoban.Bans)
+	}
+
+	if config.Honeypot != nil {
+		if len(config.Honeypot.Paths) == 0 {
+			return config, c.Err("ipfilter: At least one 'honeypot' path is required")
+		}
+		config.Enforced = append(config.Enforced, config.Honeypot.Bans)
+	}
+
+	// Resolve the hostnames with the site's resolver.
+	resolver := config.Resolver
+	if resolver == nil {
+		resolver = newResolver("")
+	}
+	for _, path := range config.Paths {
+		if path.Hosts != nil {
+			path.Hosts.Resolver = resolver
+		}
+	}
+	if config.Bots != nil {
+		config.Bots.Resolver = resolver
+	}
+
+	// Restore the bans saved by a previous run of the process.
+	if config.State != nil {
+		config.State.Lists = config.banLists()
+		if err := config.State.Restore(); err != nil {
+			return config, c.Err("ipfilter: " + err.Error())
+		}
+	}
+
+	// The admin endpoint must not be left open to everyone.
+	if config.Admin != nil && config.Admin.Token == "" && len(config.Admin.Allow) == 0 {
+		return config, c.Err("ipfilter: The admin endpoint requires an 'admin_token' or 'admin_allow'")
 	}
 
 	return config, nil
 }
 
+// banLists returns every ban list used by the config.
+func (config *IPFConfig) banLists() []*BanList {
+	var lists []*BanList
+	seen := make(map[*BanList]bool)
+	add := func(l *BanList) {
+		if l != nil && !seen[l] {
+			seen[l] = true
+			lists = append(lists, l)
+		}
+	}
+
+	for _, path := range config.Paths {
+		add(path.Bans)
+	}
+	if config.Admin != nil {
+		add(config.Admin.Bans)
+	}
+	for _, l := range config.Enforced {
+		add(l)
+	}
+	return lists
+}
+
 // ByLength sorts strings by length and alphabetically (if same length)
 type ByLength []string
 
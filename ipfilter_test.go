@@ -874,7 +874,7 @@ func TestIpfilterParseSingle(t *testing.T) {
 	for i, test := range tests {
 		c := caddy.NewTestController("http", test.inputIpfilterConfig)
 
-		actualConfig := IPFConfig{[]IPPath{test.expectedPath}, nil}
+		actualConfig := IPFConfig{Paths: []IPPath{test.expectedPath}}
 
 		actualPath, err := ipfilterParseSingle(&actualConfig, c)
 
@@ -1220,6 +1220,166 @@ func TestIPv6(t *testing.T) {
 
 }
 
+func TestReportMode(t *testing.T) {
+	TestCases := []struct {
+		inputIpfilterConfig string
+		reqIP               string
+		reqPath             string
+		expectedStatus      int
+		expectedHeader      string
+	}{
+		{
+			`ipfilter / {
+				rule block
+				ip 10.0.0.1
+				mode report
+				report_header X-Ipfilter
+			}`, "10.0.0.1:_", "/", http.StatusOK, "block",
+		},
+		{
+			`ipfilter / {
+				rule block
+				ip 10.0.0.1
+				mode report
+				report_header X-Ipfilter
+			}`, "10.0.0.2:_", "/", http.StatusOK, "allow",
+		},
+		{
+			`ipfilter / {
+				rule block
+				ip 10.0.0.1
+				mode enforce
+				report_header X-Ipfilter
+			}`, "10.0.0.1:_", "/", http.StatusForbidden, "",
+		},
+		// A block in report mode doesn't take the decision away from the
+		// enforced ones.
+		{
+			`ipfilter / {
+				rule block
+				ip 10.0.0.0/8
+			}
+			ipfilter /new {
+				rule allow
+				ip 10.0.0.1
+				mode report
+				report_header X-Ipfilter
+			}`, "10.0.0.2:_", "/new", http.StatusForbidden, "block",
+		},
+		{
+			`ipfilter / {
+				rule block
+				ip 10.0.0.0/8
+			}
+			ipfilter /new {
+				rule allow
+				ip 10.0.0.1
+				mode report
+				report_header X-Ipfilter
+			}`, "10.0.0.1:_", "/new", http.StatusForbidden, "allow",
+		},
+		{
+			`ipfilter / {
+				rule block
+				ip 10.0.0.0/8
+			}
+			ipfilter /new {
+				rule allow
+				ip 10.0.0.1
+				mode report
+			}`, "10.0.0.2:_", "/old", http.StatusForbidden, "",
+		},
+	}
+
+	for i, tc := range TestCases {
+		c := caddy.NewTestController("http", tc.inputIpfilterConfig)
+		config, err := ipfilterParse(c)
+		if err != nil {
+			t.Fatalf("Test %d failed, error generated while it should not: %v", i, err)
+		}
+
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		req, err := http.NewRequest("GET", tc.reqPath, nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = tc.reqIP
+
+		rec := httptest.NewRecorder()
+		status, _ := ipf.ServeHTTP(rec, req)
+		if status != tc.expectedStatus {
+			t.Fatalf("Test %d failed. Expected StatusCode: '%d', Got: '%d'", i, tc.expectedStatus, status)
+		}
+		if header := rec.Header().Get("X-Ipfilter"); header != tc.expectedHeader {
+			t.Errorf("Test %d failed. Expected header: '%s', Got: '%s'", i, tc.expectedHeader, header)
+		}
+	}
+}
+
+func TestOnError(t *testing.T) {
+	TestCases := []struct {
+		onError        string
+		forwardedFor   string
+		expectedStatus int
+		expectError    bool
+	}{
+		{"", "garbage", http.StatusInternalServerError, true},
+		{"on_error error", "garbage", http.StatusInternalServerError, true},
+		{"on_error allow", "garbage", http.StatusOK, false},
+		{"on_error block", "garbage", http.StatusForbidden, false},
+		{"on_error block", "10.0.0.2", http.StatusOK, false},
+	}
+
+	for i, tc := range TestCases {
+		c := caddy.NewTestController("http", `ipfilter / {
+			rule block
+			ip 10.0.0.1
+			`+tc.onError+`
+		}`)
+		config, err := ipfilterParse(c)
+		if err != nil {
+			t.Fatalf("Test %d failed, error generated while it should not: %v", i, err)
+		}
+
+		ipf := IPFilter{
+			Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+				return http.StatusOK, nil
+			}),
+			Config: config,
+		}
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = "10.0.0.3:_"
+		req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+
+		status, err := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != tc.expectedStatus {
+			t.Errorf("Test %d failed. Expected StatusCode: '%d', Got: '%d'", i, tc.expectedStatus, status)
+		}
+		if (err != nil) != tc.expectError {
+			t.Errorf("Test %d failed. Expected error: %t, Got: %v", i, tc.expectError, err)
+		}
+	}
+
+	c := caddy.NewTestController("http", `ipfilter / {
+		rule block
+		ip 10.0.0.1
+		on_error ignore
+	}`)
+	if _, err := ipfilterParse(c); err == nil {
+		t.Error("Expected an invalid on_error value to be rejected")
+	}
+}
+
 // parseCIDRs takes a slice of IPs as strings and returns them parsed via net.ParseCIDR as []*net.IPNet
 func parseCIDRs(ips []string) []*net.IPNet {
 	ipnets := make([]*net.IPNet, len(ips))
@@ -0,0 +1,77 @@
+package ipfilter
+
+import "net"
+
+// ipKeywords are the sets of special-purpose ranges that can be used in place
+// of an address, following the IANA IPv4 and IPv6 Special-Purpose Address
+// Registries (RFC 6890 and updates).
+var ipKeywords = map[string][]string{
+	"private": {
+		"10.0.0.0/8",     // RFC 1918
+		"172.16.0.0/12",  // RFC 1918
+		"192.168.0.0/16", // RFC 1918
+		"fc00::/7",       // Unique local, RFC 4193
+	},
+	"loopback": {
+		"127.0.0.0/8", // RFC 1122
+		"::1/128",     // RFC 4291
+	},
+	"link_local": {
+		"169.254.0.0/16", // RFC 3927
+		"fe80::/10",      // RFC 4291
+	},
+	"cgnat": {
+		"100.64.0.0/10", // Shared address space, RFC 6598
+	},
+	"documentation": {
+		"192.0.2.0/24",    // TEST-NET-1, RFC 5737
+		"198.51.100.0/24", // TEST-NET-2, RFC 5737
+		"203.0.113.0/24",  // TEST-NET-3, RFC 5737
+		"2001:db8::/32",   // RFC 3849
+		"3fff::/20",       // RFC 9637
+	},
+	"multicast": {
+		"224.0.0.0/4", // RFC 5771
+		"ff00::/8",    // RFC 4291
+	},
+	"reserved": {
+		"0.0.0.0/8",      // "This network", RFC 791
+		"192.0.0.0/24",   // IETF protocol assignments, RFC 6890
+		"192.88.99.0/24", // Deprecated 6to4 relay anycast, RFC 7526
+		"198.18.0.0/15",  // Benchmarking, RFC 2544
+		"240.0.0.0/4",    // Reserved and limited broadcast, RFC 1112, RFC 919
+		"::/128",         // Unspecified, RFC 4291
+		"100::/64",       // Discard-only, RFC 6666
+		"2001:2::/48",    // Benchmarking, RFC 5180
+		"2001:10::/28",   // Deprecated ORCHID, RFC 4843
+		"5f00::/16",      // Segment routing SIDs, RFC 9602
+	},
+}
+
+// ipKeywordSets are the keywords expanding to other keywords.
+var ipKeywordSets = map[string][]string{
+	// Everything which should never be the source of internet traffic.
+	"bogon": {"private", "loopback", "link_local", "cgnat", "documentation", "multicast", "reserved"},
+}
+
+// keywordNets returns the ranges of a keyword, or false if keyword isn't one.
+func keywordNets(keyword string) ([]*net.IPNet, bool) {
+	keywords := []string{keyword}
+	if set, ok := ipKeywordSets[keyword]; ok {
+		keywords = set
+	} else if _, ok := ipKeywords[keyword]; !ok {
+		return nil, false
+	}
+
+	var nets []*net.IPNet
+	for _, k := range keywords {
+		for _, cidr := range ipKeywords[k] {
+			_, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				panic("ipfilter: invalid keyword range " + cidr)
+			}
+			nets = append(nets, ipnet)
+		}
+	}
+	return nets, true
+}
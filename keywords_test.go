@@ -0,0 +1,76 @@
+package ipfilter
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPKeywords(t *testing.T) {
+	TestCases := []struct {
+		ip       string
+		keywords []string // The keywords matching ip, besides bogon.
+	}{
+		{"10.1.2.3", []string{"private"}},
+		{"172.31.255.255", []string{"private"}},
+		{"172.32.0.1", nil},
+		{"192.168.0.1", []string{"private"}},
+		{"::ffff:192.168.0.1", []string{"private"}},
+		{"fd12:3456::1", []string{"private"}},
+		{"127.0.0.1", []string{"loopback"}},
+		{"::1", []string{"loopback"}},
+		{"169.254.169.254", []string{"link_local"}},
+		{"fe80::1", []string{"link_local"}},
+		{"100.64.0.1", []string{"cgnat"}},
+		{"100.128.0.1", nil},
+		{"198.51.100.7", []string{"documentation"}},
+		{"2001:db8::1", []string{"documentation"}},
+		{"239.255.255.250", []string{"multicast"}},
+		{"ff02::1", []string{"multicast"}},
+		{"0.0.0.0", []string{"reserved"}},
+		{"255.255.255.255", []string{"reserved"}},
+		{"198.19.0.1", []string{"reserved"}},
+		{"::", []string{"reserved"}},
+		{"8.8.8.8", nil},
+		{"2001:4860:4860::8888", nil},
+	}
+
+	for _, tc := range TestCases {
+		ip := net.ParseIP(tc.ip)
+		expected := make(map[string]bool)
+		for _, k := range tc.keywords {
+			expected[k] = true
+		}
+		expected["bogon"] = len(tc.keywords) != 0
+
+		for keyword := range expected {
+			nets, err := parseIP(keyword)
+			if err != nil {
+				t.Fatalf("Can't parse keyword %s: %v", keyword, err)
+			}
+			matched := false
+			for _, ipnet := range nets {
+				if ipnet.Contains(ip) {
+					matched = true
+				}
+			}
+			if matched != expected[keyword] {
+				t.Errorf("%s: expected %s to match: %t, got %t", tc.ip, keyword, expected[keyword], matched)
+			}
+		}
+		for keyword := range ipKeywords {
+			if expected[keyword] {
+				continue
+			}
+			nets, _ := keywordNets(keyword)
+			for _, ipnet := range nets {
+				if ipnet.Contains(ip) {
+					t.Errorf("%s: unexpected match of %s by %s", tc.ip, keyword, ipnet)
+				}
+			}
+		}
+	}
+
+	if _, ok := keywordNets("public"); ok {
+		t.Error("Expected an unknown keyword not to expand")
+	}
+}
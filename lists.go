@@ -0,0 +1,288 @@
+package ipfilter
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyfile"
+)
+
+// IPList is a named set of ranges and countries, defined once with
+// `ipfilter_list <name> { ... }` in a lists file and referenced by the
+// blocks of any site loading that file with `list <name>`. Every block sees
+// the same entries, which are replaced in place when a new configuration
+// starts.
+type IPList struct {
+	Name string
+
+	mu        sync.RWMutex
+	defined   bool
+	nets      *netIndex
+	countries []string
+}
+
+var (
+	ipListsMu sync.Mutex
+	ipLists   = make(map[string]*IPList)
+)
+
+// GetIPList returns the list called name, creating an empty one if it isn't
+// defined yet.
+func GetIPList(name string) *IPList {
+	ipListsMu.Lock()
+	defer ipListsMu.Unlock()
+
+	l, ok := ipLists[name]
+	if !ok {
+		l = &IPList{Name: name}
+		ipLists[name] = l
+	}
+	return l
+}
+
+// Set replaces the entries of the list.
+func (l *IPList) Set(nets []*net.IPNet, countries []string) {
+	index := newNetIndex(nets)
+	l.mu.Lock()
+	l.nets = index
+	l.countries = countries
+	l.defined = true
+	l.mu.Unlock()
+}
+
+// unset empties the list, which is no longer defined.
+func (l *IPList) unset() {
+	l.mu.Lock()
+	l.nets = nil
+	l.countries = nil
+	l.defined = false
+	l.mu.Unlock()
+}
+
+// Defined reports whether the list was defined, rather than only referenced.
+func (l *IPList) Defined() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.defined
+}
+
+// HasCountries reports whether the list matches clients by country.
+func (l *IPList) HasCountries() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.countries) != 0
+}
+
+// MatchIP returns the range of the list containing ip, if any.
+func (l *IPList) MatchIP(ip net.IP) (*net.IPNet, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.nets == nil {
+		return nil, false
+	}
+	return l.nets.Match(ip)
+}
+
+// MatchCountry reports whether the list holds the country code.
+func (l *IPList) MatchCountry(code string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, c := range l.countries {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// ipListDef is the definition of a list, as parsed.
+type ipListDef struct {
+	nets      []*net.IPNet
+	countries []string
+}
+
+// ipListDefs are the lists defined by the files a configuration loads. They
+// are swapped in when it starts, so a configuration failing to load leaves
+// the lists in use untouched.
+type ipListDefs struct {
+	lists map[string]ipListDef
+	files map[string][]string // Names of the lists of each file, by absolute path.
+}
+
+// ipListDefsKey is where the lists of a configuration are kept in the
+// storage of its instance.
+type ipListDefsKey struct{}
+
+// getIPListDefs returns the lists defined by the configuration c is part of.
+func getIPListDefs(c *caddy.Controller) *ipListDefs {
+	if defs, ok := c.Get(ipListDefsKey{}).(*ipListDefs); ok {
+		return defs
+	}
+	defs := &ipListDefs{
+		lists: make(map[string]ipListDef),
+		files: make(map[string][]string),
+	}
+	c.Set(ipListDefsKey{}, defs)
+	c.OnStartup(defs.apply)
+	return defs
+}
+
+// apply replaces the entries of the lists with their new definitions, and
+// forgets the lists which are no longer defined.
+func (defs *ipListDefs) apply() error {
+	ipListsMu.Lock()
+	defer ipListsMu.Unlock()
+
+	for name, l := range ipLists {
+		if _, ok := defs.lists[name]; !ok {
+			l.unset()
+			delete(ipLists, name)
+		}
+	}
+	for name, def := range defs.lists {
+		l, ok := ipLists[name]
+		if !ok {
+			l = &IPList{Name: name}
+			ipLists[name] = l
+		}
+		l.Set(def.nets, def.countries)
+	}
+	return nil
+}
+
+// load parses the list definitions of file and returns the names of the
+// lists it defines. A file loaded by several sites is only parsed once.
+func (defs *ipListDefs) load(file string) ([]string, error) {
+	path, err := filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+	if names, ok := defs.files[path]; ok {
+		return names, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var names []string
+	d := caddyfile.NewDispenser(file, f)
+	for d.Next() {
+		if d.Val() != "ipfilter_list" {
+			return nil, d.Err("ipfilter: Expected an ipfilter_list definition, got " + d.Val())
+		}
+		name, err := parseIPList(&d, defs)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	defs.files[path] = names
+	return names, nil
+}
+
+// parseIPList parses an `ipfilter_list <name> { ... }` definition into defs
+// and returns the name of the list.
+func parseIPList(d *caddyfile.Dispenser, defs *ipListDefs) (string, error) {
+	args := d.RemainingArgs()
+	if len(args) != 1 {
+		return "", d.ArgErr()
+	}
+	name := args[0]
+	if _, ok := defs.lists[name]; ok {
+		return "", d.Err("ipfilter: List " + name + " is defined more than once")
+	}
+
+	var def ipListDef
+	for d.NextBlock() {
+		switch d.Val() {
+		case "ip":
+			ips := d.RemainingArgs()
+			if len(ips) == 0 {
+				return "", d.ArgErr()
+			}
+			for _, ip := range ips {
+				ipRange, err := parseIP(ip)
+				if err != nil {
+					return "", d.Err("ipfilter: " + err.Error())
+				}
+				def.nets = append(def.nets, ipRange...)
+			}
+		case "ip_file":
+			files := d.RemainingArgs()
+			if len(files) == 0 {
+				return "", d.ArgErr()
+			}
+			for _, file := range files {
+				ipRanges, err := parseIPFile(file)
+				if err != nil {
+					return "", d.Err("ipfilter: " + err.Error())
+				}
+				def.nets = append(def.nets, ipRanges...)
+			}
+		case "cloud":
+			args := d.RemainingArgs()
+			if len(args) < 2 {
+				return "", d.ArgErr()
+			}
+			filter, err := parseCloudFilters(args[2:])
+			if err != nil {
+				return "", d.Err("ipfilter: " + err.Error())
+			}
+			ipRanges, err := loadCloudRanges(args[0], args[1], filter)
+			if err != nil {
+				return "", d.Err("ipfilter: " + err.Error())
+			}
+			def.nets = append(def.nets, ipRanges...)
+		case "country":
+			codes := d.RemainingArgs()
+			if len(codes) == 0 {
+				return "", d.ArgErr()
+			}
+			def.countries = append(def.countries, codes...)
+		default:
+			return "", d.Err("ipfilter: Unknown list directive: " + d.Val())
+		}
+	}
+
+	if len(def.nets) == 0 && len(def.countries) == 0 {
+		return "", d.Err("ipfilter: List " + name + " is empty")
+	}
+	defs.lists[name] = def
+	return name, nil
+}
+
+// parseIPFile parses a file listing one address or range per line. Blank
+// lines and the text following '#' are ignored.
+func parseIPFile(fname string) ([]*net.IPNet, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var nets []*net.IPNet
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		for _, ip := range strings.Fields(text) {
+			ipRange, err := parseIP(ip)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", fname, line, err)
+			}
+			nets = append(nets, ipRange...)
+		}
+	}
+	return nets, scanner.Err()
+}
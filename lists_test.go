@@ -0,0 +1,201 @@
+package ipfilter
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyfile"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+func TestIPLists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	partners := filepath.Join(dir, "partners.txt")
+	if err := ioutil.WriteFile(partners, []byte("# partners\n10.1.0.0/16\n\n10.2.0.1 # staging\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeLists := func(name, content string) string {
+		fname := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fname, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return fname
+	}
+	lists := writeLists("lists", `ipfilter_list liststest_office {
+		ip 192.168.1.0/24 192.168.2.1
+	}
+	ipfilter_list liststest_partners {
+		ip_file `+partners+`
+	}
+	ipfilter_list liststest_geo {
+		country CA
+	}`)
+
+	c := caddy.NewTestController("http", "")
+	for _, input := range []string{
+		`ipfilter / {
+			rule allow
+			list liststest_office
+		}`,
+		`ipfilter / {
+			rule allow
+			lists ` + lists + `
+			list liststest_missing
+		}`,
+		// A list with countries requires a database.
+		`ipfilter / {
+			rule allow
+			lists ` + lists + `
+			list liststest_geo
+		}`,
+		`ipfilter / {
+			rule allow
+			lists ` + filepath.Join(dir, "missing") + `
+		}`,
+	} {
+		c.Dispenser = caddyfile.NewDispenser("Testfile", strings.NewReader(input))
+		if _, err := ipfilterParse(c); err == nil {
+			t.Errorf("Expected an error parsing %s", input)
+		}
+	}
+
+	// The file is loaded once for both sites, in any block of the site.
+	c.Dispenser = caddyfile.NewDispenser("Testfile", strings.NewReader(`ipfilter / {
+		rule allow
+		database `+DataBase+`
+		list liststest_office liststest_geo
+	}
+	ipfilter /partners {
+		rule allow
+		lists `+lists+`
+		list liststest_partners
+	}`))
+	config, err := ipfilterParse(c)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+	c.Dispenser = caddyfile.NewDispenser("Testfile", strings.NewReader(`ipfilter / {
+		rule allow
+		lists `+lists+`
+		list liststest_partners
+	}`))
+	if _, err := ipfilterParse(c); err != nil {
+		t.Fatalf("Could not parse the config of a second site: %v", err)
+	}
+
+	// The lists are only swapped in when the configuration starts.
+	office := GetIPList("liststest_office")
+	if office.Defined() {
+		t.Fatal("Expected the list not to be defined before startup")
+	}
+	if err := getIPListDefs(c).apply(); err != nil {
+		t.Fatalf("Could not apply the lists: %v", err)
+	}
+
+	ipf := IPFilter{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+	TestCases := []struct {
+		reqIP          string
+		reqPath        string
+		expectedStatus int
+	}{
+		{"192.168.1.20:_", "/", http.StatusOK},
+		{"192.168.2.1:_", "/", http.StatusOK},
+		{"192.168.3.1:_", "/", http.StatusForbidden},
+		{"24.53.192.20:_", "/", http.StatusOK}, // CA
+		{"8.8.8.8:_", "/", http.StatusForbidden},
+		{"10.1.2.3:_", "/partners", http.StatusOK},
+		{"10.2.0.1:_", "/partners", http.StatusOK},
+		{"192.168.1.20:_", "/partners", http.StatusForbidden},
+	}
+	for i, tc := range TestCases {
+		req, err := http.NewRequest("GET", tc.reqPath, nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = tc.reqIP
+		status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req)
+		if status != tc.expectedStatus {
+			t.Errorf("Test %d failed. Expected StatusCode: '%d', Got: '%d'", i, tc.expectedStatus, status)
+		}
+	}
+
+	// A configuration failing to load leaves the lists alone.
+	twice := writeLists("twice", `ipfilter_list liststest_office {
+		ip 192.168.9.0/24
+	}
+	ipfilter_list liststest_office {
+		ip 192.168.3.0/24
+	}`)
+	c = caddy.NewTestController("http", `ipfilter / {
+		rule allow
+		lists `+twice+`
+		list liststest_office
+	}`)
+	if _, err := ipfilterParse(c); err == nil {
+		t.Error("Expected a list defined twice to be an error")
+	}
+	if _, ok := office.MatchIP(net.ParseIP("192.168.1.20")); !ok {
+		t.Error("Expected the list to be left alone by a failed reload")
+	}
+
+	// A reload redefines the lists in use and forgets the others.
+	c = caddy.NewTestController("http", `ipfilter / {
+		rule allow
+		lists `+writeLists("reloaded", `ipfilter_list liststest_office {
+			ip 192.168.3.0/24
+		}`)+`
+		list liststest_office
+	}`)
+	if _, err := ipfilterParse(c); err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+	if err := getIPListDefs(c).apply(); err != nil {
+		t.Fatalf("Could not apply the lists: %v", err)
+	}
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.168.3.1:_"
+	if status, _ := ipf.ServeHTTP(httptest.NewRecorder(), req); status != http.StatusOK {
+		t.Errorf("Expected the redefined list to allow the client, got %d", status)
+	}
+	if config.Paths[1].Lists[0].Defined() {
+		t.Error("Expected the list dropped by the reload to be forgotten")
+	}
+	if GetIPList("liststest_partners") == config.Paths[1].Lists[0] {
+		t.Error("Expected the list dropped by the reload to leave the registry")
+	}
+}
+
+func TestParseIPFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := filepath.Join(dir, "bad.txt")
+	if err := ioutil.WriteFile(fname, []byte("10.0.0.1\nnot-an-ip\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseIPFile(fname); err == nil {
+		t.Error("Expected an invalid entry to be reported")
+	}
+	if _, err := parseIPFile(filepath.Join(dir, "missing.txt")); err == nil {
+		t.Error("Expected a missing file to be reported")
+	}
+}
@@ -0,0 +1,201 @@
+package ipfilter
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the evaluation
+// latency histogram.
+var latencyBuckets = []float64{.00001, .000025, .00005, .0001, .00025, .0005, .001, .0025, .005, .01, .025, .1}
+
+// Metrics counts the decisions made by the middleware and exposes them in
+// the Prometheus text format.
+type Metrics struct {
+	Path  string       // URL path the metrics are served at.
+	Allow []*net.IPNet // Remote addresses allowed, if not empty.
+
+	mu        sync.Mutex
+	evaluated uint64
+	decisions map[decisionLabels]uint64
+	buckets   []uint64 // Cumulative counts matching latencyBuckets.
+	sum       float64
+}
+
+// decisionLabels are the labels of the decisions counter.
+type decisionLabels struct {
+	block, scope, rule, reason, country, decision string
+}
+
+// newMetrics returns Metrics served at path.
+func newMetrics(path string) *Metrics {
+	return &Metrics{
+		Path:      path,
+		decisions: make(map[decisionLabels]uint64),
+		buckets:   make([]uint64, len(latencyBuckets)),
+	}
+}
+
+// Observe counts decision d, which took elapsed to make.
+func (m *Metrics) Observe(d Decision, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+
+	labels := newDecisionLabels(d)
+	seconds := elapsed.Seconds()
+
+	m.mu.Lock()
+	m.evaluated++
+	m.decisions[labels]++
+	for i, le := range latencyBuckets {
+		if seconds <= le {
+			m.buckets[i]++
+		}
+	}
+	m.sum += seconds
+	m.mu.Unlock()
+}
+
+// Report counts the decision d of a block in report mode, if it would have
+// blocked the request.
+func (m *Metrics) Report(d Decision) {
+	if m == nil || d.Allow {
+		return
+	}
+
+	labels := newDecisionLabels(d)
+	labels.decision = "report"
+
+	m.mu.Lock()
+	m.decisions[labels]++
+	m.mu.Unlock()
+}
+
+// newDecisionLabels returns the labels counting decision d.
+func newDecisionLabels(d Decision) decisionLabels {
+	labels := decisionLabels{
+		block:    "none",
+		reason:   d.Reason,
+		country:  d.Country,
+		decision: decisionString(d.Allow),
+	}
+	if d.Index >= 0 && d.Scope != "" {
+		labels.block = blockName(d.Path, d.Index)
+		labels.scope = d.Scope
+		labels.rule = "allow"
+		if d.Path.IsBlock {
+			labels.rule = "block"
+		}
+	}
+	return labels
+}
+
+// blockName returns the name of a block, or its index if it has none.
+func blockName(path IPPath, index int) string {
+	if path.Name != "" {
+		return path.Name
+	}
+	return strconv.Itoa(index)
+}
+
+// authorized checks the remote address of the request against Allow.
+func (m *Metrics) authorized(r *http.Request) bool {
+	clientIP, err := getClientIP(r, true)
+	if err != nil {
+		return false
+	}
+	return matchNets(m.Allow, clientIP)
+}
+
+// labelEscaper escapes label values as the Prometheus text format wants.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// label returns value as a quoted label value.
+func label(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+// serveMetrics writes the metrics in the Prometheus text format.
+func (ipf IPFilter) serveMetrics(w http.ResponseWriter, r *http.Request) (int, error) {
+	m := ipf.Config.Metrics
+	if !m.authorized(r) {
+		return http.StatusForbidden, nil
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	m.write(w, ipf.Config)
+	return http.StatusOK, nil
+}
+
+// write writes the metrics of config to w.
+func (m *Metrics) write(w io.Writer, config IPFConfig) {
+	m.mu.Lock()
+	evaluated := m.evaluated
+	decisions := make(map[decisionLabels]uint64, len(m.decisions))
+	for k, v := range m.decisions {
+		decisions[k] = v
+	}
+	buckets := append([]uint64(nil), m.buckets...)
+	sum := m.sum
+	m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP ipfilter_requests_evaluated_total Requests evaluated by ipfilter.")
+	fmt.Fprintln(w, "# TYPE ipfilter_requests_evaluated_total counter")
+	fmt.Fprintf(w, "ipfilter_requests_evaluated_total %d\n", evaluated)
+
+	lines := make([]string, 0, len(decisions))
+	for l, v := range decisions {
+		lines = append(lines, fmt.Sprintf("ipfilter_decisions_total{block=%s,scope=%s,rule=%s,reason=%s,country=%s,decision=%s} %d",
+			label(l.block), label(l.scope), label(l.rule), label(l.reason), label(l.country), label(l.decision), v))
+	}
+	sort.Strings(lines)
+	fmt.Fprintln(w, "# HELP ipfilter_decisions_total Decisions made by ipfilter.")
+	fmt.Fprintln(w, "# TYPE ipfilter_decisions_total counter")
+	fmt.Fprint(w, strings.Join(append(lines, ""), "\n"))
+
+	fmt.Fprintln(w, "# HELP ipfilter_evaluation_seconds Time taken to evaluate a request.")
+	fmt.Fprintln(w, "# TYPE ipfilter_evaluation_seconds histogram")
+	for i, le := range latencyBuckets {
+		fmt.Fprintf(w, "ipfilter_evaluation_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(le, 'g', -1, 64), buckets[i])
+	}
+	fmt.Fprintf(w, "ipfilter_evaluation_seconds_bucket{le=\"+Inf\"} %d\n", evaluated)
+	fmt.Fprintf(w, "ipfilter_evaluation_seconds_sum %s\n", strconv.FormatFloat(sum, 'g', -1, 64))
+	fmt.Fprintf(w, "ipfilter_evaluation_seconds_count %d\n", evaluated)
+
+	fmt.Fprintln(w, "# HELP ipfilter_cidrs Number of CIDR ranges loaded per block.")
+	fmt.Fprintln(w, "# TYPE ipfilter_cidrs gauge")
+	for i, path := range config.Paths {
+		fmt.Fprintf(w, "ipfilter_cidrs{block=%s} %d\n", label(blockName(path, i)), len(path.Nets)+path.Hosts.Len())
+	}
+
+	if config.Cache != nil {
+		hits, misses, evictions, entries := config.Cache.stats()
+		fmt.Fprintln(w, "# HELP ipfilter_cache_hits_total Lookups answered from the cache.")
+		fmt.Fprintln(w, "# TYPE ipfilter_cache_hits_total counter")
+		fmt.Fprintf(w, "ipfilter_cache_hits_total %d\n", hits)
+		fmt.Fprintln(w, "# HELP ipfilter_cache_misses_total Lookups not found in the cache.")
+		fmt.Fprintln(w, "# TYPE ipfilter_cache_misses_total counter")
+		fmt.Fprintf(w, "ipfilter_cache_misses_total %d\n", misses)
+		fmt.Fprintln(w, "# HELP ipfilter_cache_evictions_total Results dropped to make room in the cache.")
+		fmt.Fprintln(w, "# TYPE ipfilter_cache_evictions_total counter")
+		fmt.Fprintf(w, "ipfilter_cache_evictions_total %d\n", evictions)
+		fmt.Fprintln(w, "# HELP ipfilter_cache_entries Results held by the cache.")
+		fmt.Fprintln(w, "# TYPE ipfilter_cache_entries gauge")
+		fmt.Fprintf(w, "ipfilter_cache_entries %d\n", entries)
+	}
+
+	if config.DBHandler != nil {
+		fmt.Fprintln(w, "# HELP ipfilter_database_build_epoch Build time of the GeoIP database, in seconds since the epoch.")
+		fmt.Fprintln(w, "# TYPE ipfilter_database_build_epoch gauge")
+		fmt.Fprintf(w, "ipfilter_database_build_epoch %d\n", config.DBHandler.Metadata.BuildEpoch)
+	}
+}
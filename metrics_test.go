@@ -0,0 +1,117 @@
+package ipfilter
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+func TestMetrics(t *testing.T) {
+	c := caddy.NewTestController("http", fmt.Sprintf(`ipfilter / {
+		rule block
+		name countries
+		database %s
+		country CN
+		metrics /metrics 127.0.0.1
+	}
+	ipfilter /api {
+		rule allow
+		ip 10.0.0.0/8 192.168.0.0/16
+	}
+	ipfilter /api/new {
+		rule block
+		name trial
+		ip 10.0.0.1
+		mode report
+	}`, DataBase))
+	config, err := ipfilterParse(c)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+	ipf := IPFilter{
+		Next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			return http.StatusOK, nil
+		}),
+		Config: config,
+	}
+
+	serve := func(remote, path string) (int, string) {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		status, _ := ipf.ServeHTTP(rec, req)
+		return status, rec.Body.String()
+	}
+
+	serve("42.48.120.7:_", "/")     // CN, blocked
+	serve("8.8.8.8:_", "/")         // US, allowed
+	serve("10.0.0.1:_", "/api")     // allowed by ip
+	serve("8.8.8.8:_", "/api/x")    // not in the allowed ranges
+	serve("10.0.0.1:_", "/api/new") // allowed, but reported
+
+	if status, _ := serve("10.0.0.1:_", "/metrics"); status != http.StatusForbidden {
+		t.Errorf("Expected metrics to be restricted, got status %d", status)
+	}
+
+	status, body := serve("127.0.0.1:_", "/metrics")
+	if status != http.StatusOK {
+		t.Fatalf("Expected metrics, got status %d", status)
+	}
+	for _, expected := range []string{
+		"ipfilter_requests_evaluated_total 5\n",
+		`ipfilter_decisions_total{block="countries",scope="/",rule="block",reason="country",country="CN",decision="block"} 1`,
+		`ipfilter_decisions_total{block="countries",scope="/",rule="block",reason="",country="US",decision="allow"} 1`,
+		`ipfilter_decisions_total{block="1",scope="/api",rule="allow",reason="ip",country="",decision="allow"} 2`,
+		`ipfilter_decisions_total{block="trial",scope="/api/new",rule="block",reason="ip",country="",decision="report"} 1`,
+		`ipfilter_decisions_total{block="1",scope="/api",rule="allow",reason="",country="",decision="block"} 1`,
+		`ipfilter_evaluation_seconds_bucket{le="+Inf"} 5`,
+		"ipfilter_evaluation_seconds_count 5\n",
+		`ipfilter_cidrs{block="countries"} 0`,
+		`ipfilter_cidrs{block="1"} 2`,
+		"ipfilter_database_build_epoch ",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", expected, body)
+		}
+	}
+}
+
+func TestMetricsParse(t *testing.T) {
+	for _, config := range []string{
+		`ipfilter / {
+			rule block
+			metrics /metrics
+		}`,
+		`ipfilter / {
+			rule block
+			metrics /metrics garbage
+		}`,
+	} {
+		c := caddy.NewTestController("http", config)
+		if _, err := ipfilterParse(c); err == nil {
+			t.Errorf("Expected an error parsing %s", config)
+		}
+	}
+}
+
+func TestMetricsLabel(t *testing.T) {
+	for value, expected := range map[string]string{
+		"":             `""`,
+		"/api":         `"/api"`,
+		`a "b" \c`:     `"a \"b\" \\c"`,
+		"two\nlines":   `"two\nlines"`,
+		"ünïcode\ttab": "\"ünïcode\ttab\"",
+	} {
+		if got := label(value); got != expected {
+			t.Errorf("Expected %q to be %s, got %s", value, expected, got)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package ipfilter
+
+import (
+	"bytes"
+	"net"
+	"sort"
+)
+
+// netIndex is a set of ranges, deduplicated, merged and sorted by address,
+// so that looking an address up is a binary search however many ranges,
+// e.g. from a cloud provider, are loaded.
+type netIndex struct {
+	v4, v6 []*net.IPNet
+	other  []*net.IPNet // Ranges with a non-contiguous mask, looked up in turn.
+}
+
+// newNetIndex returns the index of nets.
+func newNetIndex(nets []*net.IPNet) *netIndex {
+	idx := &netIndex{}
+	for _, n := range nets {
+		n = normalizeNet(n)
+		if ones, bits := n.Mask.Size(); ones == 0 && bits == 0 {
+			idx.other = append(idx.other, n)
+		} else if len(n.IP) == net.IPv4len {
+			idx.v4 = append(idx.v4, n)
+		} else {
+			idx.v6 = append(idx.v6, n)
+		}
+	}
+	idx.v4 = mergeNets(idx.v4)
+	idx.v6 = mergeNets(idx.v6)
+	return idx
+}
+
+// normalizeNet returns n with its address masked, and IPv4 ranges in their
+// 4-byte form, as net.IPNet.Contains sees them.
+func normalizeNet(n *net.IPNet) *net.IPNet {
+	ip, mask := n.IP, n.Mask
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		if len(mask) == net.IPv6len {
+			mask = mask[12:]
+		}
+	}
+	if len(ip) != len(mask) {
+		return n
+	}
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// mergeNets sorts nets of a single family, drops the ranges contained in
+// another and merges the adjacent halves of a larger range.
+func mergeNets(nets []*net.IPNet) []*net.IPNet {
+	sort.Slice(nets, func(i, j int) bool {
+		if c := bytes.Compare(nets[i].IP, nets[j].IP); c != 0 {
+			return c < 0
+		}
+		// The larger range first, so the ones it contains are dropped.
+		oi, _ := nets[i].Mask.Size()
+		oj, _ := nets[j].Mask.Size()
+		return oi < oj
+	})
+
+	merged := make([]*net.IPNet, 0, len(nets))
+	for _, n := range nets {
+		if last := len(merged) - 1; last >= 0 && merged[last].Contains(n.IP) {
+			// Ranges are either nested or disjoint.
+			continue
+		}
+		merged = append(merged, n)
+
+		// Merge the two halves of a range, which may then be the second
+		// half of a larger one.
+		for len(merged) >= 2 {
+			a, b := merged[len(merged)-2], merged[len(merged)-1]
+			parent, ok := mergeHalves(a, b)
+			if !ok {
+				break
+			}
+			merged = append(merged[:len(merged)-2], parent)
+		}
+	}
+	return merged
+}
+
+// mergeHalves returns the range a and b are the two halves of, if they are.
+func mergeHalves(a, b *net.IPNet) (*net.IPNet, bool) {
+	onesA, bits := a.Mask.Size()
+	onesB, _ := b.Mask.Size()
+	if onesA != onesB || onesA == 0 {
+		return nil, false
+	}
+	mask := net.CIDRMask(onesA-1, bits)
+	if !a.IP.Mask(mask).Equal(b.IP.Mask(mask)) {
+		return nil, false
+	}
+	return &net.IPNet{IP: a.IP.Mask(mask), Mask: mask}, true
+}
+
+// Nets returns the merged ranges of the index.
+func (idx *netIndex) Nets() []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(idx.v4)+len(idx.v6)+len(idx.other))
+	nets = append(nets, idx.v4...)
+	nets = append(nets, idx.v6...)
+	return append(nets, idx.other...)
+}
+
+// Match returns the range containing ip, if any.
+func (idx *netIndex) Match(ip net.IP) (*net.IPNet, bool) {
+	nets := idx.v6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, nets = ip4, idx.v4
+	}
+
+	// The last range starting at or before ip is the only one which may
+	// contain it.
+	i := sort.Search(len(nets), func(i int) bool {
+		return bytes.Compare(nets[i].IP, ip) > 0
+	}) - 1
+	if i >= 0 && nets[i].Contains(ip) {
+		return nets[i], true
+	}
+
+	for _, rng := range idx.other {
+		if rng.Contains(ip) {
+			return rng, true
+		}
+	}
+	return nil, false
+}
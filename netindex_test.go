@@ -0,0 +1,80 @@
+package ipfilter
+
+import (
+	"math/rand"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestNetIndexMerge(t *testing.T) {
+	TestCases := []struct {
+		nets     []string
+		expected []string
+	}{
+		// Duplicates, e.g. the same prefix for several cloud services.
+		{[]string{"10.0.0.0/24", "10.0.0.0/24"}, []string{"10.0.0.0/24"}},
+		// Ranges contained in another.
+		{[]string{"10.0.0.7/32", "10.0.0.0/16", "10.0.3.0/24"}, []string{"10.0.0.0/16"}},
+		// The two halves of a range, merged as far as they go.
+		{[]string{"10.0.0.0/25", "10.0.0.128/25", "10.0.1.0/24", "10.0.3.0/24"}, []string{"10.0.0.0/23", "10.0.3.0/24"}},
+		// Adjacent, but not the halves of a range.
+		{[]string{"10.0.1.0/24", "10.0.2.0/24"}, []string{"10.0.1.0/24", "10.0.2.0/24"}},
+		// IPv4 first, in its 4-byte form, then IPv6.
+		{[]string{"2001:db8::/33", "::ffff:10.0.0.1/128", "2001:db8:8000::/33", "10.0.0.0/32"}, []string{"10.0.0.0/31", "2001:db8::/32"}},
+	}
+
+	for i, tc := range TestCases {
+		var got []string
+		for _, n := range newNetIndex(parseCIDRs(tc.nets)).Nets() {
+			got = append(got, n.String())
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("Test %d: expected %v, got %v", i, tc.expected, got)
+		}
+	}
+}
+
+func TestNetIndexMatch(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	var nets []*net.IPNet
+	for i := 0; i < 2000; i++ {
+		ip := make(net.IP, net.IPv4len)
+		r.Read(ip)
+		ones := 8 + r.Intn(25)
+		mask := net.CIDRMask(ones, 32)
+		nets = append(nets, &net.IPNet{IP: ip.Mask(mask), Mask: mask})
+	}
+	nets = append(nets, parseCIDRs([]string{"2001:db8::/48", "2001:db8:1::1/128"})...)
+	idx := newNetIndex(append([]*net.IPNet(nil), nets...))
+
+	contains := func(ip net.IP) bool {
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	for i := 0; i < 20000; i++ {
+		ip := make(net.IP, net.IPv4len)
+		r.Read(ip)
+		rng, ok := idx.Match(ip)
+		if ok != contains(ip) || ok && !rng.Contains(ip) {
+			t.Fatalf("Expected %s to match %t, got %v, %t", ip, contains(ip), rng, ok)
+		}
+	}
+
+	for ip, expected := range map[string]bool{
+		"2001:db8::5":     true,
+		"2001:db8:1::1":   true,
+		"2001:db8:1::2":   false,
+		"::ffff:10.0.0.1": contains(net.ParseIP("10.0.0.1")),
+		"2001:db8:ffff::": false,
+		"fe80::1":         false,
+	} {
+		if _, ok := idx.Match(net.ParseIP(ip)); ok != expected {
+			t.Errorf("Expected %s to match %t", ip, expected)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package ipfilter
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultPrefixPollInterval is how often an indexed prefix_dir is rescanned
+// when it can't be watched for changes.
+const defaultPrefixPollInterval = 30 * time.Second
+
+// prefixIndex is an in-memory copy of the file names found in a prefix_dir.
+// It lets PrefixDirBlocked answer with a map lookup instead of hitting the
+// filesystem for every request.
+type prefixIndex struct {
+	dir      string
+	interval time.Duration
+
+	mu    sync.RWMutex
+	names map[string]struct{}
+
+	stop chan struct{}
+	once sync.Once
+}
+
+// newPrefixIndex scans dir and returns an index of its entries.
+func newPrefixIndex(dir string, interval time.Duration) (*prefixIndex, error) {
+	if interval <= 0 {
+		interval = defaultPrefixPollInterval
+	}
+	idx := &prefixIndex{
+		dir:      dir,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+	if err := idx.scan(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// Has reports whether ip was listed in the prefix dir during the last scan.
+func (idx *prefixIndex) Has(ip net.IP) bool {
+	idx.mu.RLock()
+	_, ok := idx.names[canonicalIP(ip)]
+	idx.mu.RUnlock()
+	return ok
+}
+
+// scan walks the "flat" and "sharded" namespaces of the prefix dir and
+// replaces the index with what it found. File names are indexed by the
+// address they spell, whatever textual form was used to write it.
+func (idx *prefixIndex) scan() error {
+	entries := make(map[string]struct{})
+	if err := scanPrefixLevel(idx.dir, "", 0, entries); err != nil {
+		return err
+	}
+
+	names := make(map[string]struct{}, len(entries))
+	for entry := range entries {
+		if ip := prefixEntryIP(entry); ip != nil {
+			names[canonicalIP(ip)] = struct{}{}
+		}
+	}
+
+	idx.mu.Lock()
+	idx.names = names
+	idx.mu.Unlock()
+	return nil
+}
+
+// scanPrefixLevel adds the files of dir to names. Sub directories are only
+// followed for the two levels used by the sharded namespace.
+func scanPrefixLevel(dir, rel string, depth int, names map[string]struct{}) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if rel != "" {
+			name = rel + "/" + name
+		}
+		if !e.IsDir() {
+			names[name] = struct{}{}
+			continue
+		}
+		if depth < 2 {
+			if err := scanPrefixLevel(filepath.Join(dir, e.Name()), name, depth+1, names); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// canonicalIP returns the form of ip used to key prefix dir lookups.
+// IPv4-mapped IPv6 addresses are folded into their IPv4 form.
+func canonicalIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return ip.String()
+}
+
+// prefixEntryIP parses the address spelled by the file name of entry, or
+// returns nil if it isn't one. IPv6 names may use '=' in place of ':'.
+func prefixEntryIP(entry string) net.IP {
+	name := entry[strings.LastIndex(entry, "/")+1:]
+	return net.ParseIP(strings.ReplaceAll(name, "=", ":"))
+}
+
+// UnmatchablePrefixEntries returns the entries of a prefix dir, relative to
+// it, that can never match a client. When indexed is false those are the
+// entries not spelled in the exact form, and at the exact location, that
+// PrefixDirBlocked looks for; otherwise only the names that aren't an IP
+// address at all are reported.
+func UnmatchablePrefixEntries(dir string, indexed bool) ([]string, error) {
+	entries := make(map[string]struct{})
+	if err := scanPrefixLevel(dir, "", 0, entries); err != nil {
+		return nil, err
+	}
+
+	var bad []string
+	for entry := range entries {
+		ip := prefixEntryIP(entry)
+		if ip == nil {
+			bad = append(bad, entry)
+			continue
+		}
+		if indexed {
+			continue
+		}
+
+		found := false
+		for _, name := range prefixDirNames(ip) {
+			if name == entry {
+				found = true
+				break
+			}
+		}
+		if !found {
+			bad = append(bad, entry)
+		}
+	}
+	sort.Strings(bad)
+	return bad, nil
+}
+
+// subdirs returns the directories of the prefix dir that can hold entries.
+func (idx *prefixIndex) subdirs() []string {
+	dirs := []string{idx.dir}
+	level1, _ := ioutil.ReadDir(idx.dir)
+	for _, l1 := range level1 {
+		if !l1.IsDir() {
+			continue
+		}
+		p1 := filepath.Join(idx.dir, l1.Name())
+		dirs = append(dirs, p1)
+		level2, _ := ioutil.ReadDir(p1)
+		for _, l2 := range level2 {
+			if l2.IsDir() {
+				dirs = append(dirs, filepath.Join(p1, l2.Name()))
+			}
+		}
+	}
+	return dirs
+}
+
+// Start keeps the index in sync with the prefix dir until Stop is called.
+// Changes are picked up through filesystem notifications where supported,
+// otherwise the directory is rescanned periodically.
+func (idx *prefixIndex) Start() error {
+	if err := idx.watch(); err != nil {
+		log.Printf("ipfilter: Can't watch %s, polling every %s: %v", idx.dir, idx.interval, err)
+		go idx.poll()
+	}
+	return nil
+}
+
+// Stop ends the background synchronization of the index.
+func (idx *prefixIndex) Stop() error {
+	idx.once.Do(func() { close(idx.stop) })
+	return nil
+}
+
+// poll rescans the prefix dir every interval.
+func (idx *prefixIndex) poll() {
+	ticker := time.NewTicker(idx.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-idx.stop:
+			return
+		case <-ticker.C:
+			idx.rescan()
+		}
+	}
+}
+
+// rescan refreshes the index, keeping the old one if the dir is unreadable.
+func (idx *prefixIndex) rescan() {
+	if err := idx.scan(); err != nil && !os.IsNotExist(err) {
+		log.Println("ipfilter: Can't rescan prefix dir:", err)
+	}
+}
@@ -0,0 +1,106 @@
+//go:build linux
+// +build linux
+
+package ipfilter
+
+import (
+	"log"
+	"os"
+	"syscall"
+	"time"
+)
+
+// inotifyMask selects the events that change the content of a prefix dir.
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// watchDelay is how long changes are collected before a rescan, so a burst
+// of files written at once costs a single rescan.
+const watchDelay = 250 * time.Millisecond
+
+// watch uses inotify to rescan the index whenever an entry is added to or
+// removed from the prefix dir or one of its shard directories.
+func (idx *prefixIndex) watch() error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	// A non-blocking descriptor is handled by the runtime poller, so
+	// closing the file unblocks the pending Read below.
+	f := os.NewFile(uintptr(fd), "inotify")
+
+	addWatches := func() error {
+		for _, dir := range idx.subdirs() {
+			if _, err := syscall.InotifyAddWatch(fd, dir, inotifyMask); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := addWatches(); err != nil {
+		f.Close()
+		return err
+	}
+
+	go func() {
+		<-idx.stop
+		f.Close()
+	}()
+
+	go func() {
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			if _, err := f.Read(buf); err != nil {
+				idx.unwatch(f, err)
+				return
+			}
+
+			// Let the burst settle, then drop the events it queued.
+			select {
+			case <-idx.stop:
+				return
+			case <-time.After(watchDelay):
+			}
+			if err := drainEvents(f, buf); err != nil {
+				idx.unwatch(f, err)
+				return
+			}
+
+			// New shard directories have to be watched as well.
+			if err := addWatches(); err != nil {
+				log.Printf("ipfilter: Can't watch all of %s: %v", idx.dir, err)
+			}
+			idx.rescan()
+		}
+	}()
+	return nil
+}
+
+// drainEvents reads the pending events of f without waiting for more.
+func drainEvents(f *os.File, buf []byte) error {
+	if err := f.SetReadDeadline(time.Now()); err != nil {
+		return err
+	}
+	for {
+		if _, err := f.Read(buf); err != nil {
+			if os.IsTimeout(err) {
+				return f.SetReadDeadline(time.Time{})
+			}
+			return err
+		}
+	}
+}
+
+// unwatch falls back to polling after the watch failed with err, unless the
+// index is being stopped.
+func (idx *prefixIndex) unwatch(f *os.File, err error) {
+	select {
+	case <-idx.stop:
+		return
+	default:
+	}
+	f.Close()
+	log.Printf("ipfilter: Stopped watching %s, polling every %s: %v", idx.dir, idx.interval, err)
+	idx.rescan()
+	idx.poll()
+}
@@ -0,0 +1,78 @@
+//go:build linux
+// +build linux
+
+package ipfilter
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPrefixDirWatchBurst(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	idx, err := newPrefixIndex(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.watch(); err != nil {
+		t.Skipf("Can't watch %s: %v", dir, err)
+	}
+	defer idx.Stop()
+
+	// A burst of files is picked up, without polling.
+	for i := 0; i < 200; i++ {
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("10.0.%d.%d", i/100, i%100)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !idx.Has(net.ParseIP("10.0.1.99")) || !idx.Has(net.ParseIP("10.0.0.0")) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the burst of files to be indexed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPrefixDirWatchFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	idx, err := newPrefixIndex(dir, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Stop()
+
+	// A failed watch falls back to polling.
+	f, err := ioutil.TempFile(dir, ".inotify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go idx.unwatch(f, errors.New("read failed"))
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "10.1.2.3"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !idx.Has(net.ParseIP("10.1.2.3")) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the index to be polled after the watch failed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
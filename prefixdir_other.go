@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package ipfilter
+
+import "errors"
+
+// watch is only implemented on Linux, elsewhere the index is polled.
+func (idx *prefixIndex) watch() error {
+	return errors.New("filesystem notifications are not supported on this platform")
+}
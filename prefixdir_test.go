@@ -0,0 +1,137 @@
+package ipfilter
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPrefixDirIndex(t *testing.T) {
+	idx, err := newPrefixIndex(BlacklistPrefix, 0)
+	if err != nil {
+		t.Fatalf("Could not index %s: %v", BlacklistPrefix, err)
+	}
+
+	TestCases := []struct {
+		ip       string
+		expected bool
+	}{
+		{"243.1.3.15", false},
+		{"::1", true},
+		{"1234:abcd::1", true},
+		{"192.168.1.2", true},
+		{"192.168.0.1", true},
+		{"192.168.1.3", false},
+	}
+
+	var ipf IPFilter
+	indexed := IPPath{PrefixDir: BlacklistPrefix, prefixIndex: idx}
+	plain := IPPath{PrefixDir: BlacklistPrefix}
+	for _, tc := range TestCases {
+		ip := net.ParseIP(tc.ip)
+		if got := ipf.PrefixDirBlocked(ip, indexed); got != tc.expected {
+			t.Errorf("Indexed lookup of %s: expected %t, got %t", tc.ip, tc.expected, got)
+		}
+		if got := ipf.PrefixDirBlocked(ip, plain); got != tc.expected {
+			t.Errorf("Stat lookup of %s: expected %t, got %t", tc.ip, tc.expected, got)
+		}
+	}
+}
+
+func TestPrefixDirIndexSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	idx, err := newPrefixIndex(dir, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Start()
+	defer idx.Stop()
+
+	waitFor := func(name string, expected bool) {
+		deadline := time.Now().Add(2 * time.Second)
+		for idx.Has(net.ParseIP(name)) != expected {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected index to have %s: %t", name, expected)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	shard := filepath.Join(dir, "10", "1")
+	if err := os.MkdirAll(shard, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(shard, "10.1.2.3"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("10.1.2.3", true)
+
+	if err := os.Remove(filepath.Join(shard, "10.1.2.3")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("10.1.2.3", false)
+}
+
+func TestPrefixDirCanonical(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{
+		"2001=0db8=0000==1",      // non-canonical IPv6, equal-signs
+		"::ffff:10.9.8.7",        // IPv4-mapped IPv6
+		"10/1/10.1.2.3",          // properly sharded
+		"10/2/10.1.2.4",          // wrong shard
+		"README",                 // not an address
+		"2001/db8/2001:db8::abc", // properly sharded IPv6
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	idx, err := newPrefixIndex(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"2001:db8::1", "10.9.8.7", "::ffff:10.9.8.7", "10.1.2.3", "10.1.2.4", "2001:db8::abc"} {
+		if !idx.Has(net.ParseIP(ip)) {
+			t.Errorf("Expected index to match %s", ip)
+		}
+	}
+	if idx.Has(net.ParseIP("10.1.2.5")) {
+		t.Errorf("Expected index not to match 10.1.2.5")
+	}
+
+	bad, err := UnmatchablePrefixEntries(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"10/2/10.1.2.4", "2001=0db8=0000==1", "::ffff:10.9.8.7", "README"}
+	if !reflect.DeepEqual(bad, expected) {
+		t.Errorf("Expected unmatchable entries %v, got %v", expected, bad)
+	}
+
+	bad, err = UnmatchablePrefixEntries(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bad, []string{"README"}) {
+		t.Errorf("Expected unmatchable indexed entries [README], got %v", bad)
+	}
+}
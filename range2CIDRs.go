@@ -3,20 +3,31 @@ package ipfilter
 // https://groups.google.com/forum/m/#!topic/golang-nuts/rJvVwk4jwjQ
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"net"
+	"strconv"
+	"strings"
 )
 
-var allFF = net.ParseIP("255.255.255.255").To4()
+// maxWildcardNets is the largest number of ranges an address with octet
+// wildcards may expand to.
+const maxWildcardNets = 65536
 
+// range2CIDRs returns the smallest set of CIDR ranges covering a1 to a2,
+// which are both IPv4 or both IPv6 addresses.
 func range2CIDRs(a1, a2 net.IP) (r []*net.IPNet) {
-	// Warn users that they're using an old method of ranging
-	fmt.Println("ipfilter Warning: You are using an old method of ranging over IPs, it's highly recommended to switch over to CIDR notation, For more: https://caddyserver.com/docs/ipfilter")
-	maxLen := 32
-	a1 = a1.To4()
-	a2 = a2.To4()
+	if a1.To4() != nil && a2.To4() != nil {
+		a1 = a1.To4()
+		a2 = a2.To4()
+	} else {
+		a1 = a1.To16()
+		a2 = a2.To16()
+	}
+	maxLen := len(a1) * 8
 	for cmp(a1, a2) <= 0 {
-		l := 32
+		l := maxLen
 		for l > 0 {
 			m := net.CIDRMask(l-1, maxLen)
 			if cmp(a1, first(a1, m)) != 0 || cmp(last(a1, m), a2) > 0 {
@@ -26,7 +37,7 @@ func range2CIDRs(a1, a2 net.IP) (r []*net.IPNet) {
 		}
 		r = append(r, &net.IPNet{IP: a1, Mask: net.CIDRMask(l, maxLen)})
 		a1 = last(a1, net.CIDRMask(l, maxLen))
-		if cmp(a1, allFF) == 0 {
+		if allFF(a1) {
 			break
 		}
 		a1 = next(a1)
@@ -34,6 +45,16 @@ func range2CIDRs(a1, a2 net.IP) (r []*net.IPNet) {
 	return r
 }
 
+// allFF reports whether ip is the last address of its family.
+func allFF(ip net.IP) bool {
+	for _, b := range ip {
+		if b != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
 func next(ip net.IP) net.IP {
 	n := len(ip)
 	out := make(net.IP, n)
@@ -80,3 +101,96 @@ func last(ip net.IP, mask net.IPMask) net.IP {
 	}
 	return out
 }
+
+// parseRange parses a "start-end" range, where end is either a complete
+// address of the same family as start or, for IPv4, the last octet, e.g.
+// 1.1.1.1-10. It returns nil if the range is invalid or empty.
+func parseRange(s string) (net.IP, net.IP) {
+	splitted := strings.SplitN(s, "-", 2)
+	start := net.ParseIP(splitted[0])
+	if start == nil {
+		return nil, nil
+	}
+
+	end := net.ParseIP(splitted[1])
+	if end == nil && start.To4() != nil {
+		// switch the last field of start with the end, e.g 1.1.1.1 -> 1.1.1.10
+		fields := strings.Split(start.To4().String(), ".")
+		fields[3] = splitted[1]
+		end = net.ParseIP(strings.Join(fields, "."))
+	}
+	if end == nil || (start.To4() == nil) != (end.To4() == nil) {
+		return nil, nil
+	}
+	if start.To4() != nil {
+		start, end = start.To4(), end.To4()
+	} else {
+		start, end = start.To16(), end.To16()
+	}
+	if cmp(start, end) > 0 {
+		return nil, nil
+	}
+	return start, end
+}
+
+// warnLegacyRange warns that ip is written in one of the old range formats,
+// a truncated address or a range ending with its last octet.
+func warnLegacyRange(ip string) {
+	log.Printf("ipfilter: Warning: %s uses an old method of ranging over IPs, it's highly recommended to switch over to CIDR notation, For more: https://caddyserver.com/docs/ipfilter", ip)
+}
+
+// parseWildcard expands an IPv4 address with "*" in place of octets, e.g.
+// 192.168.*.0. Missing trailing octets are wildcards too. Trailing wildcards
+// make a single CIDR range, the others an address or range per value.
+func parseWildcard(s string) ([]*net.IPNet, error) {
+	fields := strings.Split(s, ".")
+	if len(fields) > 4 {
+		return nil, errors.New("too many octets")
+	}
+	for len(fields) < 4 {
+		fields = append(fields, "*")
+	}
+
+	// The trailing wildcards are covered by the mask.
+	ones := 32
+	for ones > 0 && fields[ones/8-1] == "*" {
+		ones -= 8
+	}
+
+	var octets [4][]byte
+	count := 1
+	for i, field := range fields {
+		if i*8 >= ones {
+			octets[i] = []byte{0}
+			continue
+		}
+		if field == "*" {
+			for v := 0; v < 256; v++ {
+				octets[i] = append(octets[i], byte(v))
+			}
+			count *= 256
+			continue
+		}
+		v, err := strconv.ParseUint(field, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid octet %q", field)
+		}
+		octets[i] = []byte{byte(v)}
+	}
+	if count > maxWildcardNets {
+		return nil, fmt.Errorf("expands to more than %d ranges", maxWildcardNets)
+	}
+
+	mask := net.CIDRMask(ones, 32)
+	nets := make([]*net.IPNet, 0, count)
+	for _, a := range octets[0] {
+		for _, b := range octets[1] {
+			for _, c := range octets[2] {
+				for _, d := range octets[3] {
+					nets = append(nets, &net.IPNet{IP: net.IP{a, b, c, d}, Mask: mask})
+				}
+			}
+		}
+	}
+	return nets, nil
+}
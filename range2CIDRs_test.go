@@ -0,0 +1,100 @@
+package ipfilter
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseIPRanges(t *testing.T) {
+	TestCases := []struct {
+		ip       string
+		expected []string // nil if ip is invalid
+	}{
+		// Last octet ranges, as before.
+		{"10.0.0.20-25", []string{"10.0.0.20/30", "10.0.0.24/31"}},
+		{"10.0.0.7-7", []string{"10.0.0.7/32"}},
+		// Complete IPv4 ranges.
+		{"10.0.0.5-10.0.3.200", []string{
+			"10.0.0.5/32", "10.0.0.6/31", "10.0.0.8/29", "10.0.0.16/28", "10.0.0.32/27",
+			"10.0.0.64/26", "10.0.0.128/25", "10.0.1.0/24", "10.0.2.0/24", "10.0.3.0/25",
+			"10.0.3.128/26", "10.0.3.192/29", "10.0.3.200/32",
+		}},
+		{"0.0.0.0-255.255.255.255", []string{"0.0.0.0/0"}},
+		{"255.255.255.254-255.255.255.255", []string{"255.255.255.254/31"}},
+		{"::ffff:10.0.0.1-10.0.0.2", []string{"10.0.0.1/32", "10.0.0.2/32"}},
+		// IPv6 ranges.
+		{"2001:db8::1-2001:db8::ff", []string{
+			"2001:db8::1/128", "2001:db8::2/127", "2001:db8::4/126", "2001:db8::8/125",
+			"2001:db8::10/124", "2001:db8::20/123", "2001:db8::40/122", "2001:db8::80/121",
+		}},
+		{"2001:db8::-2001:db8:ffff:ffff:ffff:ffff:ffff:ffff", []string{"2001:db8::/32"}},
+		{"::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", []string{"::/0"}},
+		{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffe-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff",
+			[]string{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffe/127"}},
+		// Octet wildcards.
+		{"192.168.*.*", []string{"192.168.0.0/16"}},
+		{"10.*", []string{"10.0.0.0/8"}},
+		{"*.*.*.*", []string{"0.0.0.0/0"}},
+		// Invalid ranges.
+		{"10.0.0.9-1", nil},
+		{"10.0.3.200-10.0.0.5", nil},
+		{"10.0.0.1-2001:db8::1", nil},
+		{"2001:db8::1-ff", nil},
+		{"10.0.0.1-", nil},
+		{"-10.0.0.1", nil},
+		{"10.0.0.1-10.0.0.256", nil},
+		{"10.0.*.256", nil},
+		{"10.0.*.0.1", nil},
+		{"*.*.*.0", nil},
+	}
+
+	for _, tc := range TestCases {
+		nets, err := parseIP(tc.ip)
+		if tc.expected == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", tc.ip, nets)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.ip, err)
+			continue
+		}
+		if actual := parseCIDRs(tc.expected); !reflect.DeepEqual(nets, actual) {
+			t.Errorf("%s: expected %v, got %v", tc.ip, actual, nets)
+		}
+	}
+
+	// Wildcards followed by an octet expand to an address per value.
+	nets, err := parseIP("10.*.0.1")
+	if err != nil || len(nets) != 256 || nets[255].String() != "10.255.0.1/32" {
+		t.Errorf("10.*.0.1: expected 256 addresses, got %d, %v", len(nets), err)
+	}
+}
+
+func TestLegacyRangeWarning(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	for ip, warned := range map[string]bool{
+		"10.0.0.20-25":             true,
+		"192.168":                  true,
+		"10.0.0.5-10.0.3.200":      false,
+		"2001:db8::1-2001:db8::ff": false,
+		"192.168.*.1":              false,
+		"10.0.0.0/8":               false,
+	} {
+		buf.Reset()
+		if _, err := parseIP(ip); err != nil {
+			t.Fatalf("Could not parse %s: %v", ip, err)
+		}
+		if got := strings.Contains(buf.String(), "old method"); got != warned {
+			t.Errorf("Expected a warning for %s: %t, got %q", ip, warned, buf.String())
+		}
+	}
+}
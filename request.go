@@ -0,0 +1,165 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+)
+
+// requestState memoizes what is resolved about the client of a request, so
+// that every block, the placeholders and the enrich headers share a single
+// parse of the headers and a single database lookup. Nothing is resolved
+// until something asks for it.
+type requestState struct {
+	ipf IPFilter
+	r   *http.Request
+
+	// The client, as resolved from each source. Sources resolving to the
+	// same IP share a lookup.
+	clients [numClientSources]*clientLookup
+
+	bypassDone bool
+	bypass     bool
+
+	id string // The ID of the request, once known.
+}
+
+// clientSource tells which address of a request is taken as the client's.
+type clientSource int
+
+const (
+	// sourceForwarded is the first X-Forwarded-For entry, if any, as the
+	// blocks without strict use.
+	sourceForwarded clientSource = iota
+	// sourceRemote is the remote address, as the strict blocks use.
+	sourceRemote
+	// sourceSite is the remote address, or the client a trusted proxy
+	// forwarded the request for. The site wide features use it.
+	sourceSite
+
+	numClientSources = iota
+)
+
+// blockSource returns the source used by a block.
+func blockSource(strict bool) clientSource {
+	if strict {
+		return sourceRemote
+	}
+	return sourceForwarded
+}
+
+// clientLookup is the client's IP and what the databases know about it.
+type clientLookup struct {
+	ip     net.IP
+	err    error
+	source string // The header the IP was taken from.
+
+	country geoLookup
+	asn     geoLookup
+
+	botsDone bool
+	bots     []string // Hostnames confirmed by forward-confirmed reverse DNS.
+}
+
+// geoLookup is the memoized result of a database lookup.
+type geoLookup struct {
+	done bool
+	rec  geoRecord
+	err  error
+}
+
+// newRequestState returns the state of r, with nothing resolved yet.
+func (ipf IPFilter) newRequestState(r *http.Request) *requestState {
+	return &requestState{ipf: ipf, r: r}
+}
+
+// client returns the client as resolved from src, parsing the request on
+// first use.
+func (s *requestState) client(src clientSource) *clientLookup {
+	if s.clients[src] != nil {
+		return s.clients[src]
+	}
+
+	var ip net.IP
+	var err error
+	var source string
+	if src == sourceSite {
+		ip, source, err = getSiteClientIP(s.r, s.ipf.Config.TrustedProxies)
+	} else {
+		ip, err = getClientIP(s.r, src == sourceRemote)
+		source = clientIPSource(s.r, src == sourceRemote)
+	}
+	for _, other := range s.clients {
+		if other != nil && err == nil && other.ip.Equal(ip) && other.source == source {
+			s.clients[src] = other
+			return other
+		}
+	}
+	s.clients[src] = &clientLookup{ip: ip, err: err, source: source}
+	return s.clients[src]
+}
+
+// clientIP returns the client's IP, as resolved from src.
+func (s *requestState) clientIP(src clientSource) (net.IP, error) {
+	c := s.client(src)
+	return c.ip, c.err
+}
+
+// country returns the country of the client, looking it up in the country
+// database on first use.
+func (s *requestState) country(src clientSource) (string, error) {
+	c := s.client(src)
+	if c.err != nil {
+		return "", c.err
+	}
+	if db := s.ipf.Config.DBHandler; db != nil && !c.country.done {
+		c.country.rec, c.country.err = s.ipf.lookupDB("country", db, c.ip)
+		c.country.done = true
+	}
+	return c.country.rec.Country.ISOCode, c.country.err
+}
+
+// asn returns the autonomous system of the client, looking it up in the ASN
+// database on first use.
+func (s *requestState) asn(src clientSource) (geoRecord, error) {
+	c := s.client(src)
+	if c.err != nil {
+		return geoRecord{}, c.err
+	}
+	if db := s.ipf.Config.ASNHandler; db != nil && !c.asn.done {
+		c.asn.rec, c.asn.err = s.ipf.lookupDB("asn", db, c.ip)
+		c.asn.done = true
+	}
+	return c.asn.rec, c.asn.err
+}
+
+// botNames returns the verified hostnames of the client, looking them up on
+// first use.
+func (s *requestState) botNames(src clientSource) ([]string, error) {
+	c := s.client(src)
+	if c.err != nil {
+		return nil, c.err
+	}
+	if !c.botsDone {
+		c.bots = s.ipf.Config.Bots.Verify(c.ip)
+		c.botsDone = true
+	}
+	return c.bots, nil
+}
+
+// bypassed reports whether the request carries a valid bypass token.
+func (s *requestState) bypassed() bool {
+	if !s.bypassDone {
+		s.bypass = s.ipf.Config.Bypass.Valid(s.r)
+		s.bypassDone = true
+	}
+	return s.bypass
+}
+
+// requestID returns the ID of the request, making one up on first use if
+// neither Caddy nor a proxy gave it one.
+func (s *requestState) requestID() string {
+	if s.id == "" {
+		s.id = requestID(s.r)
+	}
+	return s.id
+}
@@ -0,0 +1,81 @@
+package ipfilter
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+)
+
+func TestRequestState(t *testing.T) {
+	c := caddy.NewTestController("http", `ipfilter / {
+		rule block
+		database `+DataBase+`
+		country RU
+	}
+	ipfilter /private {
+		rule allow
+		ip 10.0.0.0/8
+		strict
+	}
+	ipfilter /private/eu {
+		rule allow
+		country CA
+	}`)
+	config, err := ipfilterParse(c)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+	ipf := IPFilter{Config: config}
+
+	req, err := http.NewRequest("GET", "/private/eu", nil)
+	if err != nil {
+		t.Fatalf("Could not create HTTP request: %v", err)
+	}
+	req.RemoteAddr = "24.53.192.20:_"
+
+	s := ipf.newRequestState(req)
+	d, err := ipf.decide(s)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !d.Allow || d.Country != "CA" {
+		t.Errorf("Expected to be allowed from CA, got %t from %q", d.Allow, d.Country)
+	}
+
+	// Without X-Forwarded-For both ways of resolving the client agree, so
+	// they share a single lookup.
+	if s.clients[sourceForwarded] == nil || s.clients[sourceForwarded] != s.clients[sourceRemote] {
+		t.Errorf("Expected the client to be resolved once, got %v and %v", s.clients[sourceForwarded], s.clients[sourceRemote])
+	}
+	if !s.clients[sourceForwarded].country.done {
+		t.Error("Expected the country to be memoized")
+	}
+	if s.clients[sourceForwarded].asn.done {
+		t.Error("Expected the ASN not to be looked up without an ASN database")
+	}
+
+	// A forwarded client is resolved separately from the strict one.
+	req.Header.Set("X-Forwarded-For", "8.8.8.8")
+	s = ipf.newRequestState(req)
+	if _, err := ipf.decide(s); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if s.clients[sourceForwarded] == s.clients[sourceRemote] {
+		t.Error("Expected distinct lookups for the forwarded and remote addresses")
+	}
+	if ip, _ := s.clientIP(sourceForwarded); ip.String() != "8.8.8.8" {
+		t.Errorf("Expected the forwarded address, got %s", ip)
+	}
+	if ip, _ := s.clientIP(sourceRemote); ip.String() != "24.53.192.20" {
+		t.Errorf("Expected the remote address, got %s", ip)
+	}
+
+	// The site wide features don't trust it without trusted proxies.
+	if ip, _ := s.clientIP(sourceSite); ip.String() != "24.53.192.20" {
+		t.Errorf("Expected the remote address for the site, got %s", ip)
+	}
+	if s.clients[sourceSite] != s.clients[sourceRemote] {
+		t.Error("Expected the site and remote addresses to share a lookup")
+	}
+}
@@ -0,0 +1,235 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// stateVersion is the version of the state file format written.
+	stateVersion = 1
+	// defaultStateInterval is how often the state file is written.
+	defaultStateInterval = time.Minute
+)
+
+// The lists already restored from each state file by this process, by path.
+// A reload of the configuration runs before the previous one saves its state
+// for the last time, so restoring again would bring back the bans lifted
+// since. Several sites may share a file, each restoring its own lists.
+var (
+	restoredMu sync.Mutex
+	restored   = make(map[string]map[string]bool)
+)
+
+// stateMu serializes the saves, which merge with the lists other sites
+// saved to the same file.
+var stateMu sync.Mutex
+
+// stateFile is the content of a state file.
+type stateFile struct {
+	Version int                  `json:"version"`
+	Saved   time.Time            `json:"saved"`
+	Lists   map[string][]banJSON `json:"lists"`
+}
+
+// State periodically saves ban lists to a file, so the bans added at
+// runtime survive a restart.
+type State struct {
+	Path     string
+	Interval time.Duration
+	Lists    []*BanList
+
+	stop    chan struct{}
+	done    chan struct{}
+	started bool
+	once    sync.Once
+}
+
+// newState returns a State saving to path every interval.
+func newState(path string, interval time.Duration) *State {
+	if interval <= 0 {
+		interval = defaultStateInterval
+	}
+	return &State{
+		Path:     path,
+		Interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// read returns the content of the state file. A missing file is empty.
+func (s *State) read() (stateFile, error) {
+	sf := stateFile{Version: stateVersion, Lists: make(map[string][]banJSON)}
+	data, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return sf, nil
+	}
+	if err != nil {
+		return sf, err
+	}
+
+	if err := json.Unmarshal(data, &sf); err != nil {
+		return sf, fmt.Errorf("Invalid state file %s: %v", s.Path, err)
+	}
+	if sf.Version != stateVersion {
+		return sf, fmt.Errorf("Unsupported state file version %d in %s", sf.Version, s.Path)
+	}
+	if sf.Lists == nil {
+		sf.Lists = make(map[string][]banJSON)
+	}
+	return sf, nil
+}
+
+// Load adds the bans saved in the state file to the lists. A missing file
+// isn't an error, there is nothing to restore yet.
+func (s *State) Load() error {
+	return s.load(s.Lists)
+}
+
+// load adds the bans saved in the state file to lists.
+func (s *State) load(lists []*BanList) error {
+	sf, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, l := range lists {
+		for _, bj := range sf.Lists[l.Name] {
+			ipnet, err := parseBanNet(bj.CIDR)
+			if err != nil {
+				log.Printf("ipfilter: Skipping ban in %s: %v", s.Path, err)
+				continue
+			}
+			b := Ban{Net: ipnet, Reason: bj.Reason, Created: bj.Created}
+			if bj.Expires != nil {
+				b.Expires = *bj.Expires
+			}
+			if !b.Expired(now) {
+				l.Add(b)
+			}
+		}
+	}
+	return nil
+}
+
+// Restore loads the lists of the state file which this process didn't
+// restore yet.
+func (s *State) Restore() error {
+	path, err := filepath.Abs(s.Path)
+	if err != nil {
+		return err
+	}
+
+	restoredMu.Lock()
+	defer restoredMu.Unlock()
+	var lists []*BanList
+	for _, l := range s.Lists {
+		if !restored[path][l.Name] {
+			lists = append(lists, l)
+		}
+	}
+	if err := s.load(lists); err != nil {
+		return err
+	}
+	if restored[path] == nil {
+		restored[path] = make(map[string]bool)
+	}
+	for _, l := range lists {
+		restored[path][l.Name] = true
+	}
+	return nil
+}
+
+// Save atomically replaces the state file with the current bans. The lists
+// saved to the same file by other sites are kept.
+func (s *State) Save() error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	sf, err := s.read()
+	if err != nil {
+		return err
+	}
+	sf.Saved = time.Now().UTC()
+	for _, l := range s.Lists {
+		bans := l.List()
+		list := make([]banJSON, len(bans))
+		for i, b := range bans {
+			list[i] = newBanJSON(b)
+		}
+		sf.Lists[l.Name] = list
+	}
+	data, err := json.MarshalIndent(sf, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file in the same directory and rename it over
+	// the state file, so it's never seen half written.
+	tmp, err := ioutil.TempFile(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+// Start saves the state file every interval until Stop is called.
+func (s *State) Start() error {
+	s.started = true
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(s.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				if err := s.Save(); err != nil {
+					log.Println("ipfilter: Can't save state file:", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop ends the periodic saving and saves the state a last time. Failing to
+// save is logged, so it doesn't hold up the shutdown.
+func (s *State) Stop() error {
+	stopped := false
+	s.once.Do(func() {
+		close(s.stop)
+		stopped = true
+	})
+	if !stopped {
+		return nil
+	}
+	if s.started {
+		<-s.done
+	}
+	if err := s.Save(); err != nil {
+		log.Println("ipfilter: Can't save state file:", err)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package ipfilter
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy"
+)
+
+func TestState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "bans.json")
+
+	config := `ipfilter / {
+		rule block
+		bans statetest
+		state_file ` + stateFile + ` 1h
+	}`
+
+	// Nothing to restore the first time.
+	c := caddy.NewTestController("http", config)
+	conf, err := ipfilterParse(c)
+	if err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+
+	bans := GetBanList("statetest")
+	permanent, _ := parseBanNet("10.0.0.0/24")
+	temporary, _ := parseBanNet("2001:db8::1")
+	expired, _ := parseBanNet("10.0.1.1")
+	bans.Add(Ban{Net: permanent, Reason: "scanner"})
+	bans.Add(Ban{Net: temporary, Expires: time.Now().Add(time.Hour)})
+	bans.Add(Ban{Net: expired, Expires: time.Now().Add(-time.Second)})
+
+	conf.State.Start()
+	conf.State.Stop()
+	if _, err := os.Stat(stateFile); err != nil {
+		t.Fatalf("Could not save state: %v", err)
+	}
+
+	// A reload doesn't restore the bans lifted since.
+	bans.Remove(permanent.String())
+	c = caddy.NewTestController("http", config)
+	if _, err := ipfilterParse(c); err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+	if b, ok := bans.Match(net.ParseIP("10.0.0.7")); ok {
+		t.Errorf("Expected lifted ban to stay lifted on reload, got %v", b)
+	}
+
+	// Simulate a restart.
+	for _, b := range bans.List() {
+		bans.Remove(b.Net.String())
+	}
+	forgetRestored(stateFile)
+	c = caddy.NewTestController("http", config)
+	if _, err := ipfilterParse(c); err != nil {
+		t.Fatalf("Could not parse config: %v", err)
+	}
+
+	list := bans.List()
+	if len(list) != 2 {
+		t.Fatalf("Expected 2 bans to be restored, got %v", list)
+	}
+	if b, ok := bans.Match(net.ParseIP("10.0.0.7")); !ok || b.Reason != "scanner" || !b.Expires.IsZero() {
+		t.Errorf("Expected permanent ban to be restored, got %v", b)
+	}
+	if b, ok := bans.Match(net.ParseIP("2001:db8::1")); !ok || b.Expires.IsZero() {
+		t.Errorf("Expected temporary ban to be restored, got %v", b)
+	}
+
+	// Unknown versions are refused.
+	if err := ioutil.WriteFile(stateFile, []byte(`{"version": 99}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	forgetRestored(stateFile)
+	c = caddy.NewTestController("http", config)
+	if _, err := ipfilterParse(c); err == nil {
+		t.Errorf("Expected unsupported state file version to be an error")
+	}
+}
+
+// forgetRestored makes the state file at path restored again, as if by a new
+// process.
+func forgetRestored(path string) {
+	restoredMu.Lock()
+	delete(restored, path)
+	restoredMu.Unlock()
+}
+
+func TestStateShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "bans.json")
+
+	configs := []string{`ipfilter / {
+		rule block
+		bans statesharedA
+		state_file ` + stateFile + ` 1h
+	}`, `ipfilter / {
+		rule block
+		bans statesharedB
+		state_file ` + stateFile + ` 1h
+	}`}
+	parse := func() []*State {
+		var states []*State
+		for _, config := range configs {
+			conf, err := ipfilterParse(caddy.NewTestController("http", config))
+			if err != nil {
+				t.Fatalf("Could not parse config: %v", err)
+			}
+			states = append(states, conf.State)
+		}
+		return states
+	}
+
+	// Each site saves its own list, keeping the other's.
+	states := parse()
+	a, b := GetBanList("statesharedA"), GetBanList("statesharedB")
+	netA, _ := parseBanNet("10.0.0.1")
+	netB, _ := parseBanNet("10.0.0.2")
+	a.Add(Ban{Net: netA})
+	b.Add(Ban{Net: netB})
+	for _, s := range states {
+		if err := s.Save(); err != nil {
+			t.Fatalf("Could not save state: %v", err)
+		}
+	}
+
+	// Both lists are restored on restart.
+	a.Remove(netA.String())
+	b.Remove(netB.String())
+	forgetRestored(stateFile)
+	parse()
+	if _, ok := a.Match(net.ParseIP("10.0.0.1")); !ok {
+		t.Error("Expected the first site's ban to be restored")
+	}
+	if _, ok := b.Match(net.ParseIP("10.0.0.2")); !ok {
+		t.Error("Expected the second site's ban to be restored")
+	}
+}